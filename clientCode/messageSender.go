@@ -1,12 +1,25 @@
+//go:build !uploader
+
 package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,51 +31,340 @@ type Node struct {
 	Port      string  `json:"nearest_node_port"`
 }
 
-func main() {
-	lat := 40.730610
-	lon := -73.935242
+// Consecutive failed requests before the client moves on to the next node
+const maxNodeFailures = 3
 
-	mainServerURL := fmt.Sprintf("https://nodepulse-5jb7.onrender.com/redirect-client?lat=%f&lon=%f", lat, lon)
+// How often the client reports observed latency to the main server
+const rttReportInterval = 10 * time.Second
 
-	// Print the URL for debugging purposes
-	log.Printf("Requesting nearest node from URL: %s", mainServerURL)
+// Files the signed fleet snapshot and the main server's public key are cached in between runs
+const (
+	fleetCacheFile = "fleet_cache.json"
+	fleetKeyFile   = "fleet_key.pub"
+)
+
+// Node entry in the fleet snapshot
+type FleetNode struct {
+	ID        string  `json:"id"`
+	IPAddress string  `json:"ip_address"`
+	Port      string  `json:"port"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Nearby nodes as signed by the main server
+type FleetSnapshot struct {
+	Version   uint64      `json:"version"`
+	IssuedAt  time.Time   `json:"issued_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	Nodes     []FleetNode `json:"nodes"`
+}
+
+// Snapshot bytes exactly as signed, with the signature
+type SignedFleet struct {
+	Snapshot  json.RawMessage `json:"snapshot"`
+	Signature string          `json:"signature"`
+}
+
+// Redirect response: the chosen node plus the fleet snapshot
+type RedirectResponse struct {
+	Node
+	Fleet *SignedFleet `json:"fleet"`
+}
 
-	// Make an HTTP GET request to the main server
-	resp, err := http.Get(mainServerURL)
+// Timeout for calls to the main server, so an unresponsive one falls back to the cache
+var mainServerClient = &http.Client{Timeout: 10 * time.Second}
+
+// Load the main server's fleet key: FLEET_PUBLIC_KEY, the cached copy, or fetched once over HTTPS and pinned
+func fleetPublicKey(mainServer string) (ed25519.PublicKey, error) {
+	encoded := os.Getenv("FLEET_PUBLIC_KEY")
+	if encoded == "" {
+		if data, err := os.ReadFile(fleetKeyFile); err == nil {
+			encoded = strings.TrimSpace(string(data))
+		}
+	}
+	if encoded == "" {
+		// Over plain HTTP anyone on the path could hand us their own key to pin
+		if !strings.HasPrefix(mainServer, "https://") {
+			return nil, fmt.Errorf("main server is not HTTPS; set FLEET_PUBLIC_KEY to its /fleet-key")
+		}
+		resp, err := mainServerClient.Get(mainServer + "/fleet-key")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var body struct {
+			PublicKey string `json:"public_key"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		encoded = body.PublicKey
+		if err := os.WriteFile(fleetKeyFile, []byte(encoded+"\n"), 0644); err != nil {
+			log.Printf("Error caching fleet key: %v", err)
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid fleet public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Check the snapshot signature and expiry
+func verifyFleet(signed SignedFleet, key ed25519.PublicKey) (FleetSnapshot, error) {
+	var snapshot FleetSnapshot
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(key, signed.Snapshot, signature) {
+		return snapshot, fmt.Errorf("bad fleet signature")
+	}
+	if err := json.Unmarshal(signed.Snapshot, &snapshot); err != nil {
+		return snapshot, err
+	}
+	if time.Now().After(snapshot.ExpiresAt) {
+		return snapshot, fmt.Errorf("fleet snapshot expired at %s", snapshot.ExpiresAt)
+	}
+	return snapshot, nil
+}
+
+// Read the cached snapshot, if it is still valid
+func loadCachedFleet(key ed25519.PublicKey) (FleetSnapshot, error) {
+	data, err := os.ReadFile(fleetCacheFile)
+	if err != nil {
+		return FleetSnapshot{}, err
+	}
+	var signed SignedFleet
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return FleetSnapshot{}, err
+	}
+	return verifyFleet(signed, key)
+}
+
+// Cache a verified snapshot unless the cache already holds a newer one
+func cacheFleet(signed SignedFleet, snapshot FleetSnapshot, key ed25519.PublicKey) {
+	if cached, err := loadCachedFleet(key); err == nil && cached.Version > snapshot.Version {
+		return
+	}
+	data, err := json.Marshal(signed)
 	if err != nil {
-		log.Fatalf("Error making HTTP request: %v", err)
+		log.Printf("Error encoding fleet snapshot: %v", err)
+		return
+	}
+	if err := os.WriteFile(fleetCacheFile, data, 0644); err != nil {
+		log.Printf("Error caching fleet snapshot: %v", err)
+	}
+}
+
+// Distance between two coordinates in kilometres
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Base URL of a node: registered URLs are used as-is, bare addresses get the node's port
+func nodeURL(node Node) string {
+	if strings.Contains(node.IPAddress, "://") {
+		return strings.TrimRight(node.IPAddress, "/")
+	}
+	return "http://" + net.JoinHostPort(node.IPAddress, node.Port)
+}
+
+// Append the snapshot's nodes, nearest first, skipping ones already listed
+func appendFleetNodes(candidates []Node, snapshot FleetSnapshot, lat, lon float64) []Node {
+	fleet := append([]FleetNode(nil), snapshot.Nodes...)
+	sort.Slice(fleet, func(i, j int) bool {
+		return distanceKm(lat, lon, fleet[i].Latitude, fleet[i].Longitude) < distanceKm(lat, lon, fleet[j].Latitude, fleet[j].Longitude)
+	})
+	for _, entry := range fleet {
+		duplicate := false
+		for _, candidate := range candidates {
+			if candidate.ID == entry.ID {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			candidates = append(candidates, Node{ID: entry.ID, IPAddress: entry.IPAddress, Latitude: entry.Latitude, Longitude: entry.Longitude, Port: entry.Port})
+		}
 	}
-	defer resp.Body.Close()
+	return candidates
+}
 
-	// Check for non-200 HTTP status codes
-	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Unexpected status code: %d", resp.StatusCode)
+// File the client's ID is kept in, so the main server can send it back to the same node
+const clientIDFile = "client_id"
+
+// Load the client's ID, creating one on first run
+func loadOrCreateClientID() string {
+	if data, err := os.ReadFile(clientIDFile); err == nil {
+		if clientID := strings.TrimSpace(string(data)); clientID != "" {
+			return clientID
+		}
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating client ID: %v", err)
+		return ""
 	}
+	clientID := hex.EncodeToString(buf)
+	if err := os.WriteFile(clientIDFile, []byte(clientID+"\n"), 0644); err != nil {
+		log.Printf("Error saving client ID: %v", err)
+	}
+	return clientID
+}
+
+// Ask the main server for the nearest node, falling back to the cached fleet when it is unavailable.
+// The result is the nodes to try, in order: the main server's choice, then signed snapshot entries.
+func findNodes(mainServer string, lat, lon float64, capability string) ([]Node, error) {
+	query := url.Values{}
+	query.Set("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+	query.Set("lon", strconv.FormatFloat(lon, 'f', -1, 64))
+	query.Set("capability", capability)
+	if clientID := loadOrCreateClientID(); clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	redirectURL := mainServer + "/redirect-client?" + query.Encode()
+	log.Printf("Requesting nearest node from URL: %s", redirectURL)
 
-	// Decode the response body into the `Node` struct
-	var nearestNode Node
-	if err := json.NewDecoder(resp.Body).Decode(&nearestNode); err != nil {
-		log.Fatalf("Error decoding response body: %v", err)
+	key, keyErr := fleetPublicKey(mainServer)
+	if keyErr != nil {
+		log.Printf("Fleet key unavailable, cached fallback disabled: %v", keyErr)
 	}
 
+	var redirect RedirectResponse
+	resp, err := mainServerClient.Get(redirectURL)
+	if err == nil {
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&redirect)
+		}
+		resp.Body.Close()
+	}
+
+	if err == nil {
+		candidates := []Node{redirect.Node}
+		if redirect.Fleet != nil && keyErr == nil {
+			snapshot, err := verifyFleet(*redirect.Fleet, key)
+			if err != nil {
+				log.Printf("Ignoring fleet snapshot: %v", err)
+			} else {
+				cacheFleet(*redirect.Fleet, snapshot, key)
+				candidates = appendFleetNodes(candidates, snapshot, lat, lon)
+			}
+		}
+		return candidates, nil
+	}
+
+	log.Printf("Main server unavailable (%v), using the cached fleet", err)
+	if keyErr != nil {
+		return nil, fmt.Errorf("main server unavailable and no fleet key to verify the cache with: %v", err)
+	}
+	snapshot, cacheErr := loadCachedFleet(key)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("main server unavailable (%v) and no usable cached fleet: %v", err, cacheErr)
+	}
+	candidates := appendFleetNodes(nil, snapshot, lat, lon)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("main server unavailable (%v) and the cached fleet has no nodes", err)
+	}
+	return candidates, nil
+}
+
+func main() {
+	lat := 40.730610
+	lon := -73.935242
+
+	mainServer := "https://nodepulse-5jb7.onrender.com"
+
+	// Nodes to try: the one the main server picked, then cached nearby nodes
+	candidates, err := findNodes(mainServer, lat, lon, "receive")
+	for err != nil {
+		log.Printf("No node to send to: %v", err)
+		time.Sleep(10 * time.Second) // Wait for the main server to come back
+		candidates, err = findNodes(mainServer, lat, lon, "receive")
+	}
+	nearestNode := candidates[0]
+
 	// Print the nearest node details for logging/debugging
 	log.Printf("Redirected to nearest server node:\n"+
 		"  ID: %s\n  IP: %s\n  Latitude: %.6f\n  Longitude: %.6f\n  Port: %s",
 		nearestNode.ID, nearestNode.IPAddress, nearestNode.Latitude, nearestNode.Longitude, nearestNode.Port)
 
-	// Construct the URL to send messages
-	messageURL := fmt.Sprintf("%s/receive", nearestNode.IPAddress)
-	log.Printf("Connecting to server node at: %s", messageURL)
+	// Start sending messages, moving to the next node when one stops responding
+	sendMessages(mainServer, lat, lon, candidates)
+}
+
+// Report the round trip observed to a node, with the client's location rounded to about 10 km
+func reportRTT(mainServer string, node Node, lat, lon float64, latency time.Duration) {
+	data, err := json.Marshal(map[string]interface{}{
+		"node_id": node.ID,
+		"lat":     math.Round(lat*10) / 10,
+		"lon":     math.Round(lon*10) / 10,
+		"rtt_ms":  float64(latency.Microseconds()) / 1000,
+	})
+	if err != nil {
+		log.Printf("Error encoding RTT report: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(mainServer+"/report-rtt", "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Error reporting RTT: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
 
-	// Start sending messages
-	sendMessages(messageURL)
+// Try the node a full node pointed at right after the current one. The hint is unsigned, so it is
+// only followed to a node the main server handed out itself; anything else is ignored
+func addAlternative(candidates []Node, current int, alternative string) []Node {
+	if alternative == "" {
+		return candidates
+	}
+	alternative = strings.TrimRight(alternative, "/")
+	for i := current + 1; i < len(candidates); i++ {
+		if nodeURL(candidates[i]) != alternative {
+			continue
+		}
+		reordered := append([]Node(nil), candidates[:current+1]...)
+		reordered = append(reordered, candidates[i])
+		reordered = append(reordered, candidates[current+1:i]...)
+		return append(reordered, candidates[i+1:]...)
+	}
+	log.Printf("Ignoring alternative node %s: not one of the nodes the main server handed out", alternative)
+	return candidates
 }
 
-func sendMessages(url string) {
+func sendMessages(mainServer string, lat, lon float64, candidates []Node) {
 	message := map[string]string{
 		"message": "Hello there",
 	}
 
+	current, failures := 0, 0
+	var lastReport time.Time
+	url := nodeURL(candidates[current]) + "/receive"
+	log.Printf("Connecting to server node at: %s", url)
+
+	// Count a failed request and switch nodes after too many in a row
+	nodeFailed := func() {
+		failures++
+		if failures < maxNodeFailures || len(candidates) < 2 {
+			return
+		}
+		current, failures = (current+1)%len(candidates), 0
+		url = nodeURL(candidates[current]) + "/receive"
+		log.Printf("Node not responding, switching to node %s at: %s", candidates[current].ID, url)
+	}
+
 	for {
 		// Encode the message into JSON format
 		jsonData, err := json.Marshal(message)
@@ -79,10 +381,10 @@ func sendMessages(url string) {
 		resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
 		if err != nil {
 			log.Printf("Error making HTTP POST request: %v", err)
+			nodeFailed()
 			time.Sleep(5 * time.Second) // Wait before retrying
 			continue
 		}
-		defer resp.Body.Close()
 
 		// Measure end time for latency
 		end := time.Now()
@@ -91,8 +393,9 @@ func sendMessages(url string) {
 		latency := end.Sub(start)
 		log.Printf("Latency to server: %v", latency)
 
-		// Read the raw response body
+		// Read the raw response body, closing it right away since this loop never returns
 		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
 			log.Printf("Error reading response body: %v", err)
 			time.Sleep(5 * time.Second) // Wait before retrying
@@ -105,9 +408,22 @@ func sendMessages(url string) {
 		// Check for non-200 HTTP status codes
 		if resp.StatusCode != http.StatusOK {
 			log.Printf("Unexpected status code: %d", resp.StatusCode)
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				// The node is full: move on right away, trying the peer it suggests next
+				candidates = addAlternative(candidates, current, resp.Header.Get("X-Alternative-Node"))
+				failures = maxNodeFailures - 1
+			}
+			nodeFailed()
 			time.Sleep(5 * time.Second) // Wait before retrying
 			continue
 		}
+		failures = 0
+
+		// Let the main server learn the latency clients here see to this node
+		if time.Since(lastReport) >= rttReportInterval {
+			go reportRTT(mainServer, candidates[current], lat, lon, latency)
+			lastReport = time.Now()
+		}
 
 		// Decode the response body into a map
 		var result map[string]interface{}
@@ -1,21 +1,55 @@
+//go:build !node
+
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"container/heap"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log"
 	"math"
+	"math/big"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"log"
 
 	"github.com/rs/cors"
 	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/mem"
 	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
 )
 
 // Node structure for storing node details
@@ -26,15 +60,186 @@ type Node struct {
 	Longitude float64 `json:"longitude"`
 	Status    string  `json:"status"`
 	Port      string  `json:"port"`
+
+	RegisteredAt  time.Time `json:"registered_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Verified      bool      `json:"verified"`         // False for entries restored from disk until a health check passes
+	Draining      bool      `json:"draining"`         // Set while the node finishes in-flight work before leaving
+	Load          *NodeLoad `json:"load,omitempty"`   // Utilization reported with the latest heartbeat
+	KeyID         string    `json:"key_id,omitempty"` // Pre-shared key the node registered with; later calls must use it too
+
+	Region       string   `json:"region,omitempty"`
+	Zone         string   `json:"zone,omitempty"`
+	Tags         []string `json:"tags,omitempty"`         // Free-form labels, e.g. "laptop"
+	Capabilities []string `json:"capabilities,omitempty"` // Services offered, e.g. "upload", "receive", "websocket"
+	Capacity     int      `json:"capacity,omitempty"`     // Concurrent client sessions the node is sized for (0 = unspecified)
+	Version      string   `json:"version,omitempty"`      // Node software version
+}
+
+// Capabilities assumed for nodes that register without declaring any (older node builds)
+var defaultCapabilities = []string{"receive", "upload"}
+
+// Requirements a client can place on the node it is sent to
+type nodeFilter struct {
+	Capabilities []string  // Node must offer all of these
+	Tags         []string  // Node must carry all of these
+	Region       string    // Node must be in this region, if set
+	Fence        *geofence // Data-residency rules the node must satisfy, if any apply to the client
+	Client       string    // Client being placed: nodes at capacity are skipped unless they already serve it
+	Source       string    // Address the client came from
+}
+
+// Read capability, tag and region requirements from query parameters (comma-separated or repeated)
+func parseNodeFilter(query url.Values) nodeFilter {
+	return nodeFilter{
+		Capabilities: normalizeLabels(query["capability"]),
+		Tags:         normalizeLabels(query["tag"]),
+		Region:       strings.ToLower(strings.TrimSpace(query.Get("region"))),
+	}
+}
+
+// Lowercase, trim, split on commas and de-duplicate a list of labels
+func normalizeLabels(values []string) []string {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, label := range strings.Split(value, ",") {
+			label = strings.ToLower(strings.TrimSpace(label))
+			if label == "" || seen[label] {
+				continue
+			}
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// Check whether a node satisfies a client's requirements
+func (filter nodeFilter) matches(node Node) bool {
+	if filter.Region != "" && filter.Region != node.Region {
+		return false
+	}
+	if filter.Fence != nil && !filter.Fence.allows(node) {
+		return false
+	}
+	if filter.Client != "" && !hasRoom(node, filter.Client, time.Now()) {
+		return false
+	}
+	return containsAll(node.Capabilities, filter.Capabilities) && containsAll(node.Tags, filter.Tags)
+}
+
+// Check whether every wanted label is present
+func containsAll(labels []string, wanted []string) bool {
+	for _, want := range wanted {
+		found := false
+		for _, label := range labels {
+			if label == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Utilization a node reports with its heartbeats
+type NodeLoad struct {
+	CPUPercent    float64   `json:"cpu_percent"`
+	MemoryPercent float64   `json:"memory_percent"`
+	LoadAverage   float64   `json:"load_average"`
+	ActiveClients int       `json:"active_clients"` // Clients seen by the node recently
+	ReportedAt    time.Time `json:"reported_at"`
 }
 
 var (
 	nodes       = make(map[string]Node) // Store nodes in memory
-	mutex       = &sync.Mutex{}         // Mutex for synchronizing access to nodes
-	clientCount = 0                     // Global counter for connected clients
-	clientMutex = &sync.Mutex{}         // Mutex for synchronizing access to clientCount
+	mutex       = &sync.RWMutex{}       // Mutex for synchronizing access to nodes; lookups only take the read lock
+	clientCount = make(map[string]int)  // Clients currently assigned to each node
+	clientMutex = &sync.Mutex{}         // Mutex for synchronizing access to clientCount and clientAssignments
+)
+
+// Lease settings for node heartbeats (overridable through environment variables)
+var (
+	heartbeatInterval  = envDuration("HEARTBEAT_INTERVAL", 10*time.Second) // How often nodes are expected to renew their lease
+	suspectAfterMisses = envInt("SUSPECT_AFTER_MISSES", 2)                 // Missed heartbeats before a node is "suspect"
+	downAfterMisses    = envInt("DOWN_AFTER_MISSES", 4)                    // Missed heartbeats before a node is "down"
+	evictAfter         = envDuration("EVICT_AFTER", 10*time.Minute)        // Silence after which a node is removed from the registry
 )
 
+// Result of the latest health probes against a node
+type ProbeResult struct {
+	LastProbe            time.Time `json:"last_probe"`
+	LastRTTMillis        float64   `json:"last_rtt_ms"`
+	LastError            string    `json:"last_error,omitempty"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	Reachable            bool      `json:"reachable"`
+}
+
+var probes = make(map[string]ProbeResult) // Latest probe results per node ID, guarded by mutex
+
+// Health probe settings (overridable through environment variables)
+var (
+	probeInterval          = envDuration("PROBE_INTERVAL", 15*time.Second) // How often every node's /health is checked
+	probeTimeout           = envDuration("PROBE_TIMEOUT", 3*time.Second)   // Timeout for a single probe
+	probeFailureThreshold  = envInt("PROBE_FAILURE_THRESHOLD", 3)          // Consecutive failures before a node is "unreachable"
+	probeRecoveryThreshold = envInt("PROBE_RECOVERY_THRESHOLD", 2)         // Consecutive successes before it is reachable again
+)
+
+// Read a duration from the environment, falling back to a default
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Invalid %s value %q, using %v\n", name, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// Read a string from the environment, falling back to a default
+func envString(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Read an integer from the environment, falling back to a default
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		log.Printf("Invalid %s value %q, using %d\n", name, value, fallback)
+		return fallback
+	}
+	return number
+}
+
+// Read a non-negative number from the environment, falling back to a default
+func envFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		log.Printf("Invalid %s value %q, using %v\n", name, value, fallback)
+		return fallback
+	}
+	return number
+}
+
 // Register Node Handler
 func registerNodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -44,23 +249,77 @@ func registerNodeHandler(w http.ResponseWriter, r *http.Request) {
 
 	var node Node
 	err := json.NewDecoder(r.Body).Decode(&node)
-	if err != nil || node.ID == "" || node.IPAddress == "" {
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if node.ID, err = resolveNodeID(r, node.ID); err != nil {
+		rejectNodeRequest(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if node.ID == "" || node.IPAddress == "" || node.Capacity < 0 {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if err := validateCoordinates(node.Latitude, node.Longitude); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Normalize metadata so filters can match it exactly
+	node.Region = strings.ToLower(strings.TrimSpace(node.Region))
+	node.Zone = strings.ToLower(strings.TrimSpace(node.Zone))
+	node.Tags = normalizeLabels(node.Tags)
+	node.Capabilities = normalizeLabels(node.Capabilities)
+	if len(node.Capabilities) == 0 {
+		node.Capabilities = defaultCapabilities
+	}
+
+	// Start a fresh lease for the node
+	now := time.Now()
+	node.Status = "active"
+	node.RegisteredAt = now
+	node.LastHeartbeat = now
+	node.Verified = true
+	node.Draining = false
 
-	// Add node to the map
+	// Bind the node to the key it authenticated with
+	node.KeyID = authenticatedKeyID(r)
+
+	// Add node to the map, merging a re-registration and replacing ghosts on the same endpoint
 	mutex.Lock()
-	nodes[node.ID] = node
+	if existing, exists := nodes[node.ID]; exists {
+		if existing.KeyID != node.KeyID {
+			mutex.Unlock()
+			rejectNodeRequest(w, r, "node ID registered with another key", http.StatusForbidden)
+			return
+		}
+		node.RegisteredAt = existing.RegisteredAt
+	}
+	if owner := endpointOwnedByOtherKey(node); owner != "" {
+		mutex.Unlock()
+		rejectNodeRequest(w, r, "endpoint registered by node "+owner+" with another key", http.StatusConflict)
+		return
+	}
+	replaced := removeEndpointDuplicates(node)
+	delete(probes, node.ID)
+	putNode(node)
+	journalPut(node)
+	seeds := gossipSeeds(node)
 	mutex.Unlock()
 
 	// Log to active log
 	logToActiveLog("Node registered", node)
 
 	// Respond with a success message
-	response := map[string]string{
-		"message": "Node registered successfully",
-		"node_id": node.ID,
+	response := map[string]interface{}{
+		"message":            "Node registered successfully",
+		"node_id":            node.ID,
+		"heartbeat_interval": heartbeatInterval.String(),
+		"peers":              seeds,
+	}
+	if len(replaced) > 0 {
+		response["replaced_node_ids"] = strings.Join(replaced, ",")
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -68,244 +327,5552 @@ func registerNodeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Node registered: %+v\n", node)
 }
 
-// Find the nearest node for a client
-func findNearestNode(clientLat, clientLon float64) Node {
-	var nearest Node
-	minDistance := math.MaxFloat64
-
-	fmt.Println(nearest)
+// Key identifying the endpoint a node is served from, independent of its ID
+func endpointKey(node Node) string {
+	return strings.ToLower(strings.TrimRight(node.IPAddress, "/")) + "|" + node.Port
+}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+// ID of a node on the same endpoint that was registered with a different key, if any (caller holds mutex)
+func endpointOwnedByOtherKey(node Node) string {
+	key := endpointKey(node)
+	for id, other := range nodes {
+		if id != node.ID && endpointKey(other) == key && other.KeyID != node.KeyID {
+			return id
+		}
+	}
+	return ""
+}
 
-	for _, node := range nodes {
-		if node.Status != "active" {
+// Remove entries that share the node's endpoint under a different ID (caller holds mutex)
+func removeEndpointDuplicates(node Node) []string {
+	key := endpointKey(node)
+	var replaced []string
+	for id, other := range nodes {
+		if id == node.ID || endpointKey(other) != key {
 			continue
 		}
-		distance := calculateDistance(clientLat, clientLon, node.Latitude, node.Longitude)
-		if distance < minDistance {
-			minDistance = distance
-			nearest = node
-		}
+		removeNode(id)
+		journalDelete(id)
+		replaced = append(replaced, id)
+		logToActiveLog("Node replaced by "+node.ID, other)
+		fmt.Printf("Node %s replaced by %s on endpoint %s\n", id, node.ID, node.IPAddress)
 	}
-
-	return nearest
+	return replaced
 }
 
-// Distance calculation between two geo-coordinates
-func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	const R = 6371 // Earth's radius in km
-	dLat := (lat2 - lat1) * math.Pi / 180
-	dLon := (lon2 - lon1) * math.Pi / 180
+// Node authentication settings: every control call from a node is signed with a pre-shared key
+var (
+	nodeKeysFile          = envString("NODE_KEYS_FILE", filepath.Join(registryFolder, "node_keys.json")) // JSON object mapping key IDs to secrets
+	allowUnauthenticated  = os.Getenv("ALLOW_UNAUTHENTICATED_NODES") == "true"                           // Local development only
+	maxSignatureClockSkew = envDuration("AUTH_MAX_SKEW", 5*time.Minute)                                  // Oldest/newest accepted request timestamp
+)
 
-	lat1 = lat1 * math.Pi / 180
-	lat2 = lat2 * math.Pi / 180
+var (
+	nodeKeys        = make(map[string][]byte)    // Secrets by key ID, loaded at startup
+	seenSignatures  = make(map[string]time.Time) // Recently accepted signatures, to reject replays
+	signaturesMutex = &sync.Mutex{}              // Mutex for synchronizing access to seenSignatures
+)
 
-	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
-	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
-	return R * c
+// Who a node control call was authenticated as
+type nodeIdentity struct {
+	KeyID  string // Pre-shared key, from the HMAC signature or the client certificate
+	NodeID string // Node ID from the client certificate; empty for HMAC-signed calls
 }
 
-// Collect system metrics and log data
-func collectSystemMetrics() (map[string]interface{}, error) {
-	memoryStats, err := mem.VirtualMemory()
+type nodeIdentityContextKey struct{}
+
+// Load the pre-shared node keys
+func loadNodeKeys() error {
+	data, err := os.ReadFile(nodeKeysFile)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("parsing %s: %v", nodeKeysFile, err)
 	}
+	for keyID, secret := range secrets {
+		if secret == "" {
+			return fmt.Errorf("empty secret for key %q", keyID)
+		}
+		nodeKeys[keyID] = []byte(secret)
+	}
+	fmt.Printf("Loaded %d node keys\n", len(nodeKeys))
+	return nil
+}
 
-	cpuUsage, err := cpu.Percent(time.Second, false)
+// Require a valid HMAC signature on node control calls
+//
+// Nodes send X-Node-Key-Id, X-Node-Timestamp (Unix seconds) and X-Node-Signature, the hex
+// HMAC-SHA256 of "METHOD\nREQUEST-URI\nTIMESTAMP\n" followed by the request body.
+//
+// Calls arriving on the mTLS listener with a verified client certificate are authenticated by
+// the certificate instead, as long as the key it was issued under is still in NODE_KEYS_FILE.
+func withNodeAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = withPeerVerification(r)
+		if identity, ok := certificateIdentity(r); ok {
+			if _, known := nodeKeys[identity.KeyID]; !known && !allowUnauthenticated {
+				rejectNodeRequest(w, r, fmt.Sprintf("certificate issued under revoked key %q", identity.KeyID), http.StatusUnauthorized)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), nodeIdentityContextKey{}, identity)))
+			return
+		}
+		if allowUnauthenticated {
+			next(w, r)
+			return
+		}
+
+		keyID, err := verifyNodeSignature(r)
+		if err != nil {
+			rejectNodeRequest(w, r, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		identity := nodeIdentity{KeyID: keyID}
+		next(w, r.WithContext(context.WithValue(r.Context(), nodeIdentityContextKey{}, identity)))
+	}
+}
+
+// Check the signature headers against the body, leaving the body readable for the handler
+func verifyNodeSignature(r *http.Request) (string, error) {
+	keyID := r.Header.Get("X-Node-Key-Id")
+	timestamp := r.Header.Get("X-Node-Timestamp")
+	signature := r.Header.Get("X-Node-Signature")
+	if keyID == "" || timestamp == "" || signature == "" {
+		return "", fmt.Errorf("missing signature headers")
+	}
+
+	secret, known := nodeKeys[keyID]
+	if !known {
+		return "", fmt.Errorf("unknown key %q", keyID)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("invalid timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > maxSignatureClockSkew || skew < -maxSignatureClockSkew {
+		return "", fmt.Errorf("timestamp outside the accepted window")
 	}
 
-	loadStats, err := load.Avg()
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("reading body: %v", err)
 	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
 
-	powerConsumption := cpuUsage[0] // Assume power consumption correlates with CPU usage (in a very simplified manner)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), timestamp)
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	provided, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(provided, expected) {
+		return "", fmt.Errorf("bad signature")
+	}
 
-	metrics := map[string]interface{}{
-		"Memory Used %":              memoryStats.UsedPercent,
-		"CPU Usage %":                cpuUsage[0],
-		"Load Average":               loadStats.Load1,
-		"Power Consumption (estimate)": powerConsumption, // in percentage
+	// A valid signature is only accepted once within the timestamp window
+	if !firstUseOfSignature(keyID+":"+signature, signedAt) {
+		return "", fmt.Errorf("replayed request")
 	}
+	return keyID, nil
+}
 
-	// Log to passive log
-	logToPassiveLog("System Metrics Collected", metrics)
+// Remember an accepted signature until its timestamp leaves the window, reporting whether it was new
+func firstUseOfSignature(replayKey string, signedAt time.Time) bool {
+	signaturesMutex.Lock()
+	defer signaturesMutex.Unlock()
+	now := time.Now()
+	for seen, expires := range seenSignatures {
+		if now.After(expires) {
+			delete(seenSignatures, seen)
+		}
+	}
+	if _, replayed := seenSignatures[replayKey]; replayed {
+		return false
+	}
+	seenSignatures[replayKey] = signedAt.Add(maxSignatureClockSkew)
+	return true
+}
 
-	return metrics, nil
+// Identity a request was authenticated as (empty when authentication is disabled)
+func requestIdentity(r *http.Request) nodeIdentity {
+	identity, _ := r.Context().Value(nodeIdentityContextKey{}).(nodeIdentity)
+	return identity
 }
 
-// Save metrics to the active log
-func logToActiveLog(action string, details interface{}) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	file, err := os.OpenFile("active_log_MainServer.csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Error opening active log file: %v\n", err)
-		return
-	}
-	defer file.Close()
+// Key ID a request was authenticated with ("" when authentication is disabled)
+func authenticatedKeyID(r *http.Request) string {
+	return requestIdentity(r).KeyID
+}
 
-	logEntry := fmt.Sprintf("[%s] ACTION: %s, DETAILS: %+v\n", timestamp, action, details)
-	if _, err := file.WriteString(logEntry); err != nil {
-		log.Printf("Error writing to active log file: %v\n", err)
+// Node ID a control call acts on: the certificate's node ID when one was presented, otherwise the claimed ID
+func resolveNodeID(r *http.Request, claimedID string) (string, error) {
+	certifiedID := requestIdentity(r).NodeID
+	if certifiedID == "" {
+		return claimedID, nil
 	}
+	if claimedID != "" && claimedID != certifiedID {
+		return "", fmt.Errorf("node ID %q does not match certificate for %q", claimedID, certifiedID)
+	}
+	return certifiedID, nil
 }
 
-// Save metrics to the passive log
-func logToPassiveLog(action string, details interface{}) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	file, err := os.OpenFile("passive_log_MainServer.csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Error opening passive log file: %v\n", err)
-		return
+// mTLS settings: the main server acts as a small CA and issues certificates to enrolled nodes
+var (
+	mtlsPort     = os.Getenv("MTLS_PORT")                         // Port of the mTLS listener for node control calls; empty disables mTLS
+	mtlsRequired = os.Getenv("MTLS_REQUIRED") == "true"           // Reject control calls that do not present a node certificate
+	mtlsHosts    = envString("MTLS_HOSTS", "localhost,127.0.0.1") // Names and addresses in the main server's certificate
+	nodeCertTTL  = envDuration("NODE_CERT_TTL", 90*24*time.Hour)  // Lifetime of issued node certificates
+)
+
+var (
+	caCertificate *x509.Certificate // CA that signs node and server certificates
+	caKey         crypto.Signer     // CA private key
+	caPEM         []byte            // CA certificate handed to nodes at enrollment
+)
+
+// Identity from a verified client certificate: node ID in the common name, key ID in the organizational unit
+func certificateIdentity(r *http.Request) (nodeIdentity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return forwardedIdentity(r)
 	}
-	defer file.Close()
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName == "" {
+		return nodeIdentity{}, false
+	}
+	identity := nodeIdentity{NodeID: subject.CommonName}
+	if len(subject.OrganizationalUnit) > 0 {
+		identity.KeyID = subject.OrganizationalUnit[0]
+	}
+	return identity, true
+}
 
-	logEntry := fmt.Sprintf("[%s] ACTION: %s, DETAILS: %+v\n", timestamp, action, details)
-	if _, err := file.WriteString(logEntry); err != nil {
-		log.Printf("Error writing to passive log file: %v\n", err)
+// Reject control calls without a node certificate when MTLS_REQUIRED is set
+func withRequiredCertificate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mtlsRequired {
+			if requestIdentity(r).NodeID == "" { // Set by withNodeAuth from the certificate, never from an HMAC signature
+				rejectNodeRequest(w, r, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
 	}
 }
 
-// Redirect Client Handler (find nearest node and notify)
-func redirectClientHandler(w http.ResponseWriter, r *http.Request) {
-	clientLat := r.URL.Query().Get("lat")
-	clientLon := r.URL.Query().Get("lon")
+// Load the CA from the registry folder, creating it on first start
+func loadOrCreateCA() error {
+	certPath := filepath.Join(registryFolder, "ca.pem")
+	keyPath := filepath.Join(registryFolder, "ca-key.pem")
 
-	if clientLat == "" || clientLon == "" {
-		http.Error(w, "Missing client location parameters", http.StatusBadRequest)
-		return
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return fmt.Errorf("invalid PEM in %s or %s", certPath, keyPath)
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return fmt.Errorf("parsing CA certificate: %v", err)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return fmt.Errorf("parsing CA key: %v", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("CA key cannot sign")
+		}
+		caCertificate, caKey, caPEM = cert, signer, certPEM
+		return nil
 	}
 
-	var lat, lon float64
-	_, err := fmt.Sscanf(clientLat, "%f", &lat)
+	if err := os.MkdirAll(registryFolder, 0755); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		http.Error(w, "Invalid latitude value", http.StatusBadRequest)
-		return
+		return err
 	}
-	_, err = fmt.Sscanf(clientLon, "%f", &lon)
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "NodePulse CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
 	if err != nil {
-		http.Error(w, "Invalid longitude value", http.StatusBadRequest)
-		return
+		return err
 	}
-
-	// Find the nearest node
-	nearestNode := findNearestNode(lat, lon)
-	if nearestNode.ID == "" {
-		http.Error(w, "No active nodes found", http.StatusInternalServerError)
-		return
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
 	}
-	fmt.Println(nearestNode)
-	// Collect system metrics
-	metrics, err := collectSystemMetrics()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
-		log.Printf("Error collecting system metrics: %v\n", err)
-	} else {
-		// Save metrics to passive log
-		logToPassiveLog("System Metrics Collected", metrics)
+		return err
 	}
 
-	// Respond with the nearest node information
-	response := map[string]string{
-		"nearest_node_id":   nearestNode.ID,
-		"nearest_node_ip":   nearestNode.IPAddress,
-		"nearest_node_port": nearestNode.Port,
-		"nearest_node_lat":  fmt.Sprintf("%f", nearestNode.Latitude),
-		"nearest_node_lon":  fmt.Sprintf("%f", nearestNode.Longitude),
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return err
 	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	caCertificate, caKey, caPEM = cert, key, certPEM
+	logToActiveLog("CA created", certPath)
+	return nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// Random serial number for issued certificates
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		log.Fatalf("Error generating certificate serial: %v", err)
+	}
+	return serial
+}
 
-	// Notify the nearest node asynchronously
-	go func() {
-		sendMessageToNode(nearestNode, "Client redirected to your server")
-	}()
+// Issue the main server's own TLS certificate for the mTLS listener
+func issueServerCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "NodePulse main server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range strings.Split(mtlsHosts, ",") {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCertificate, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
 }
 
-// Send a message to a specific server node
-func sendMessageToNode(node Node, message string) {
-	// Prepare the message payload
-	msg := map[string]string{
-		"node_id": node.ID,
-		"message": message,
+// Enroll Node Handler (sign a node's CSR; the call itself is HMAC-authenticated)
+//
+// The response is signed with the node's key (X-Enrollment-Signature: hex HMAC-SHA256 of the
+// request's X-Node-Signature, a newline and the response body) so the node can trust the CA
+// certificate it receives over plain HTTP.
+func enrollNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if caCertificate == nil {
+		http.Error(w, "mTLS is not enabled on this server", http.StatusNotFound)
+		return
+	}
+	keyID := authenticatedKeyID(r)
+	secret, known := nodeKeys[keyID]
+	if !known {
+		rejectNodeRequest(w, r, "enrollment requires a signed request", http.StatusUnauthorized)
+		return
 	}
 
-	// Marshal the message into JSON
-	data, err := json.Marshal(msg)
-	if err != nil {
-		fmt.Println("Error marshalling message:", err)
+	var request struct {
+		ID  string `json:"id"`
+		CSR string `json:"csr"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	block, _ := pem.Decode([]byte(request.CSR))
+	if block == nil {
+		http.Error(w, "Invalid CSR", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		http.Error(w, "Invalid CSR", http.StatusBadRequest)
+		return
+	}
+	if csr.Subject.CommonName != request.ID {
+		rejectNodeRequest(w, r, "CSR common name does not match node ID", http.StatusForbidden)
 		return
 	}
 
-	// Construct the node's URL
-	url := fmt.Sprintf("%s", node.IPAddress)
-	fmt.Printf("Sending message to node: %s\n", url)
+	// A node ID stays bound to the key it registered with
+	mutex.RLock()
+	existing, exists := nodes[request.ID]
+	mutex.RUnlock()
+	if exists && existing.KeyID != keyID {
+		rejectNodeRequest(w, r, "node ID registered with another key", http.StatusForbidden)
+		return
+	}
 
-	// Send the message to the server node
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: request.ID, OrganizationalUnit: []string{keyID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(nodeCertTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCertificate, csr.PublicKey, caKey)
 	if err != nil {
-		fmt.Println("Error sending message to node:", err)
+		http.Error(w, "Error issuing certificate", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Log the response from the server node
-	respBody, _ := io.ReadAll(resp.Body)
-	fmt.Printf("Response from node: %s\n", respBody)
+	body, err := json.Marshal(map[string]string{
+		"certificate":    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"ca_certificate": string(caPEM),
+	})
+	if err != nil {
+		http.Error(w, "Error encoding certificate", http.StatusInternalServerError)
+		return
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n", r.Header.Get("X-Node-Signature"))
+	mac.Write(body)
+
+	logToActiveLog("Node certificate issued", map[string]string{"node_id": request.ID, "key_id": keyID})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Enrollment-Signature", hex.EncodeToString(mac.Sum(nil)))
+	w.Write(body)
+}
+
+// Serve node control calls over mutual TLS
+func serveMTLS(handler http.Handler) {
+	serverCertificate, err := issueServerCertificate()
+	if err != nil {
+		log.Printf("Error issuing main server certificate, mTLS disabled: %v\n", err)
+		return
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCertificate)
+
+	server := &http.Server{
+		Addr:    ":" + mtlsPort,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCertificate},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	fmt.Println("mTLS listener is running on port", mtlsPort)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		log.Printf("Error starting mTLS listener: %v\n", err)
+	}
+}
+
+// Log and refuse a node control call
+func rejectNodeRequest(w http.ResponseWriter, r *http.Request, reason string, statusCode int) {
+	logToActiveLog("Rejected node request", map[string]string{
+		"path":   r.URL.Path,
+		"remote": r.RemoteAddr,
+		"key_id": r.Header.Get("X-Node-Key-Id"),
+		"reason": reason,
+	})
+	fmt.Printf("Rejected node request to %s from %s: %s\n", r.URL.Path, r.RemoteAddr, reason)
+	http.Error(w, "Node request rejected: "+reason, statusCode)
+}
+
+// Heartbeat Handler (renews the lease of a registered node)
+func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var heartbeat struct {
+		ID   string    `json:"id"`
+		Load *NodeLoad `json:"load"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&heartbeat)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if heartbeat.ID, err = resolveNodeID(r, heartbeat.ID); err != nil {
+		rejectNodeRequest(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if heartbeat.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	node, exists := nodes[heartbeat.ID]
+	if exists && node.KeyID != authenticatedKeyID(r) {
+		mutex.Unlock()
+		rejectNodeRequest(w, r, "heartbeat signed with another node's key", http.StatusForbidden)
+		return
+	}
+	if exists {
+		now := time.Now()
+		node.LastHeartbeat = now
+		if heartbeat.Load != nil {
+			heartbeat.Load.ReportedAt = now
+			node.Load = heartbeat.Load
+		}
+		node = updateStatus(node, now)
+		journalHeartbeat(node)
+	}
+	mutex.Unlock()
+
+	// Unknown nodes (evicted or registered before a restart) must register again
+	if !exists {
+		http.Error(w, "Node not registered", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]string{
+		"message":            "Heartbeat received",
+		"node_id":            node.ID,
+		"heartbeat_interval": heartbeatInterval.String(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Registry persistence settings: a snapshot plus an append-only journal of changes since it
+var (
+	registryFolder = envString("REGISTRY_DIR", "mainServerData") // Folder holding the snapshot and journal
+	snapshotEvery  = envInt("SNAPSHOT_EVERY", 500)               // Journal entries after which a new snapshot is written
+)
+
+const (
+	snapshotFileName = "registry_snapshot.json"
+	journalFileName  = "registry_journal.jsonl"
+)
+
+// Entry in the registry journal (and in the replication stream between main servers)
+type registryRecord struct {
+	Seq      uint64    `json:"seq"`
+	Op       string    `json:"op"` // "put" stores Node, "delete" removes NodeID
+	Node     *Node     `json:"node,omitempty"`
+	NodeID   string    `json:"node_id,omitempty"`
+	Time     time.Time `json:"time"`
+	Volatile bool      `json:"volatile,omitempty"` // Replicated but not journaled (heartbeat renewals)
+}
+
+// Registry snapshot file layout
+type registrySnapshot struct {
+	SavedAt time.Time `json:"saved_at"`
+	Seq     uint64    `json:"seq"`
+	Term    uint64    `json:"term,omitempty"` // Replication term the registry was written in
+	Nodes   []Node    `json:"nodes"`
+}
+
+var (
+	journalFile    *os.File // Open journal, guarded by mutex
+	journalEntries = 0      // Entries written since the last snapshot
+	registrySeq    uint64   // Sequence number of the last registry change, guarded by mutex
+)
+
+// Read the last snapshot and the changes journaled after it, without touching the files (caller holds mutex)
+func readRegistry() (int, error) {
+	data, err := os.ReadFile(filepath.Join(registryFolder, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("reading registry snapshot: %v", err)
+	}
+	if err == nil {
+		var snapshot registrySnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return 0, fmt.Errorf("parsing registry snapshot: %v", err)
+		}
+		for _, node := range snapshot.Nodes {
+			putNode(node)
+		}
+		registrySeq = snapshot.Seq
+		replicationMutex.Lock()
+		replicationTerm = snapshot.Term
+		replicationMutex.Unlock()
+	}
+	return replayJournal()
+}
+
+// Restore the registry from disk and start a fresh journal
+func loadRegistry() error {
+	if err := os.MkdirAll(registryFolder, 0755); err != nil {
+		return fmt.Errorf("creating registry folder: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	replayed, err := readRegistry()
+	if err != nil {
+		return err
+	}
+
+	// Drop ghosts left by earlier registrations on the same endpoint, keeping the newest entry
+	newest := make(map[string]Node)
+	for id, node := range nodes {
+		key := endpointKey(node)
+		if kept, seen := newest[key]; seen {
+			if kept.RegisteredAt.After(node.RegisteredAt) {
+				removeNode(id)
+				continue
+			}
+			removeNode(kept.ID)
+		}
+		newest[key] = node
+	}
+
+	// Restored entries stay unverified until they pass a health check, with a fresh lease
+	now := time.Now()
+	for _, node := range nodes {
+		node.Verified = false
+		node.Status = "unverified"
+		node.LastHeartbeat = now
+		putNode(node)
+	}
+	fmt.Printf("Registry restored: %d nodes (%d journal entries replayed)\n", len(nodes), replayed)
+	logToActiveLog("Registry restored", fmt.Sprintf("%d nodes", len(nodes)))
+
+	// Fold everything into a new snapshot and open an empty journal
+	return writeSnapshot()
+}
+
+// Apply every journal entry on top of the loaded snapshot (caller holds mutex)
+func replayJournal() (int, error) {
+	file, err := os.Open(filepath.Join(registryFolder, journalFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("opening registry journal: %v", err)
+	}
+	defer file.Close()
+
+	snapshotSeq := registrySeq
+	replayed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record registryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn final write from a crash; everything before it is intact
+			log.Printf("Skipping unreadable journal entry: %v\n", err)
+			continue
+		}
+		if record.Seq <= snapshotSeq {
+			continue // Already in the snapshot; a crash came between writing it and truncating the journal
+		}
+		applyRecord(record)
+		if record.Seq > registrySeq {
+			registrySeq = record.Seq
+		}
+		replayed++
+	}
+	return replayed, scanner.Err()
+}
+
+// Apply a journaled or replicated change to the registry (caller holds mutex)
+func applyRecord(record registryRecord) {
+	switch record.Op {
+	case "put":
+		if record.Node != nil {
+			putNode(*record.Node)
+		}
+	case "delete":
+		removeNode(record.NodeID)
+	}
+}
+
+// Write the whole registry to a new snapshot and truncate the journal (caller holds mutex)
+func writeSnapshot() error {
+	data, err := json.MarshalIndent(currentSnapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding registry snapshot: %v", err)
+	}
+
+	// Write to a temporary file and rename so a crash never leaves a partial snapshot
+	snapshotPath := filepath.Join(registryFolder, snapshotFileName)
+	tempPath := snapshotPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("writing registry snapshot: %v", err)
+	}
+	if err := os.Rename(tempPath, snapshotPath); err != nil {
+		return fmt.Errorf("replacing registry snapshot: %v", err)
+	}
+
+	if journalFile != nil {
+		journalFile.Close()
+	}
+	journalFile, err = os.OpenFile(filepath.Join(registryFolder, journalFileName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		journalFile = nil
+		return fmt.Errorf("opening registry journal: %v", err)
+	}
+	journalEntries = 0
+	return nil
+}
+
+// Append a change to the journal, snapshotting when it grows too long (caller holds mutex)
+func appendJournal(record registryRecord) {
+	if journalFile == nil {
+		return // Persistence is unavailable; keep serving from memory
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding journal entry: %v\n", err)
+		return
+	}
+	if _, err := journalFile.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing journal entry: %v\n", err)
+		return
+	}
+	if err := journalFile.Sync(); err != nil {
+		log.Printf("Error syncing journal: %v\n", err)
+	}
+
+	journalEntries++
+	if snapshotEvery > 0 && journalEntries >= snapshotEvery {
+		if err := writeSnapshot(); err != nil {
+			log.Printf("Error writing registry snapshot: %v\n", err)
+		}
+	}
+}
+
+// Number a registry change, journal it and queue it for the backups (caller holds mutex)
+func commitRecord(record registryRecord) {
+	registrySeq++
+	record.Seq = registrySeq
+	record.Time = time.Now()
+	if !record.Volatile {
+		appendJournal(record)
+	}
+	queueReplication(record)
+}
+
+// Journal a new or changed node (caller holds mutex)
+func journalPut(node Node) {
+	commitRecord(registryRecord{Op: "put", Node: &node})
+}
+
+// Journal a removed node (caller holds mutex)
+func journalDelete(nodeID string) {
+	commitRecord(registryRecord{Op: "delete", NodeID: nodeID})
+}
+
+// Replicate a lease renewal without journaling it (caller holds mutex)
+func journalHeartbeat(node Node) {
+	commitRecord(registryRecord{Op: "put", Node: &node, Volatile: true})
+}
+
+// Replication settings: several main servers share the registry with a primary/backup protocol.
+// A server that reaches a majority of PEERS elects the first reachable one as primary, unless a
+// reachable server already leads the newest term. The primary owns every registry change and
+// streams the numbered records to the others, tagged with its term so that backups can refuse a
+// primary that was deposed. Backups serve reads from their copy and forward node control calls
+// to the primary.
+var (
+	peerURLs          = envList("PEERS")                                  // Base URLs of all main servers, this one included, in priority order
+	selfURL           = strings.TrimRight(os.Getenv("SELF_URL"), "/")     // This server's entry in PEERS
+	replicationKey    = []byte(os.Getenv("REPLICATION_KEY"))              // Shared secret for calls between main servers
+	peerCheckInterval = envDuration("PEER_CHECK_INTERVAL", 2*time.Second) // How often peers are checked
+	replicationWait   = envDuration("REPLICATION_WAIT", 3*time.Second)    // How long a registry change waits for a majority of PEERS to apply it
+)
+
+const replicationLogLimit = 10000 // Records kept for backups that fall behind before a full snapshot is sent instead
+
+// What this server knows about another main server
+type peerState struct {
+	Alive        bool
+	Seq          uint64 // Last sequence number the peer reported or acknowledged
+	Term         uint64 // Last term the peer reported
+	Primary      string // Server that leads the peer's term, itself when it leads
+	Reaches      bool   // Whether the peer is in touch with that primary, or is it
+	Acked        uint64 // Last sequence number the peer applied in this server's current term as primary
+	NeedsInstall bool   // Send a full snapshot before streaming records again
+	Wake         chan struct{}
+}
+
+var (
+	replicationLog   []registryRecord              // Recent records, guarded by mutex
+	peers            = make(map[string]*peerState) // Other main servers by URL, guarded by replicationMutex
+	currentPrimary   string                        // URL of the current primary, empty without a majority, guarded by replicationMutex
+	replicationTerm  uint64                        // Newest election term this server knows of, guarded by replicationMutex
+	termPrimary      string                        // Server that leads replicationTerm, guarded by replicationMutex
+	replicationAcked = make(chan struct{})         // Closed and replaced whenever a backup applies records, guarded by replicationMutex
+	replicationMutex = &sync.Mutex{}               // Mutex for synchronizing access to peers, currentPrimary and the term
+	peerClient       = &http.Client{Timeout: 5 * time.Second}
+)
+
+// Term and sender carried by every replication call
+type replicationEnvelope struct {
+	Term    uint64 `json:"term"`
+	Primary string `json:"primary"`
+}
+
+// A backup's answer to a replication call, and every server's /replica/status
+type replicationReply struct {
+	Seq     uint64 `json:"seq"`
+	Term    uint64 `json:"term"`
+	Primary string `json:"primary,omitempty"`
+	Reaches bool   `json:"reaches_primary,omitempty"` // Only in /replica/status
+}
+
+// Read a comma-separated list from the environment
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimRight(strings.TrimSpace(item), "/"); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Check whether this server runs as one of several replicas
+func replicationEnabled() bool {
+	return len(peerURLs) > 1
+}
+
+// Check whether this server currently owns registry changes
+func isPrimary() bool {
+	if !replicationEnabled() {
+		return true
+	}
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	return currentPrimary == selfURL
+}
+
+// Keep a committed record for the backups and wake their replicators (caller holds mutex)
+func queueReplication(record registryRecord) {
+	if !replicationEnabled() {
+		return
+	}
+	replicationLog = append(replicationLog, record)
+	if len(replicationLog) > replicationLogLimit {
+		replicationLog = append([]registryRecord(nil), replicationLog[len(replicationLog)-replicationLogLimit:]...)
+	}
+
+	replicationMutex.Lock()
+	for _, peer := range peers {
+		select {
+		case peer.Wake <- struct{}{}:
+		default:
+		}
+	}
+	replicationMutex.Unlock()
+}
+
+// Sign a call to another main server with the replication key: hex HMAC-SHA256 of
+// "METHOD\nREQUEST-URI\nTIMESTAMP\nNONCE\n" + body, the random nonce keeping every call unique
+func signPeerRequest(req *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	mac := hmac.New(sha256.New, replicationKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x\n", req.Method, req.URL.RequestURI(), timestamp, nonce)
+	mac.Write(body)
+	req.Header.Set("X-Peer-Timestamp", timestamp)
+	req.Header.Set("X-Peer-Nonce", hex.EncodeToString(nonce))
+	req.Header.Set("X-Peer-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Check a call from another main server, leaving the body readable for the handler; each signature is accepted once
+func verifyPeerRequest(r *http.Request) error {
+	timestamp := r.Header.Get("X-Peer-Timestamp")
+	nonce := r.Header.Get("X-Peer-Nonce")
+	signature := r.Header.Get("X-Peer-Signature")
+	if len(replicationKey) == 0 || timestamp == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("missing peer signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > maxSignatureClockSkew || skew < -maxSignatureClockSkew {
+		return fmt.Errorf("timestamp outside the accepted window")
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("reading body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, replicationKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), timestamp, nonce)
+	mac.Write(body)
+	provided, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(provided, mac.Sum(nil)) {
+		return fmt.Errorf("bad peer signature")
+	}
+	if !firstUseOfSignature("peer:"+signature, signedAt) {
+		return fmt.Errorf("replayed request")
+	}
+	return nil
+}
+
+// Only accept calls signed by another main server
+func withPeerAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyPeerRequest(r); err != nil {
+			logToActiveLog("Rejected peer request", map[string]string{"path": r.URL.Path, "remote": r.RemoteAddr, "reason": err.Error()})
+			http.Error(w, "Peer request rejected: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Send a signed JSON call to another main server and decode the JSON answer
+func callPeer(method, peerURL, path string, payload interface{}, result interface{}) (int, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, peerURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signPeerRequest(req, body)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil && resp.StatusCode == http.StatusOK {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+type peerVerificationContextKey struct{}
+
+// Check a call's peer signature once and keep the outcome on the request, since every signature
+// is only accepted once
+func withPeerVerification(r *http.Request) *http.Request {
+	if r.Header.Get("X-Peer-Signature") == "" {
+		return r
+	}
+	if _, checked := r.Context().Value(peerVerificationContextKey{}).(bool); checked {
+		return r
+	}
+	err := verifyPeerRequest(r)
+	if err != nil {
+		logToActiveLog("Rejected peer request", map[string]string{"path": r.URL.Path, "remote": r.RemoteAddr, "reason": err.Error()})
+	}
+	return r.WithContext(context.WithValue(r.Context(), peerVerificationContextKey{}, err == nil))
+}
+
+// Check whether a request was signed by another main server
+func fromPeer(r *http.Request) bool {
+	verified, _ := r.Context().Value(peerVerificationContextKey{}).(bool)
+	return verified
+}
+
+// Response held back until a registry change is confirmed by a majority of PEERS
+type heldResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (held *heldResponse) Header() http.Header            { return held.header }
+func (held *heldResponse) Write(data []byte) (int, error) { return held.body.Write(data) }
+func (held *heldResponse) WriteHeader(statusCode int)     { held.statusCode = statusCode }
+
+// Send the held response to the client
+func (held *heldResponse) release(w http.ResponseWriter) {
+	for name, values := range held.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(held.statusCode)
+	w.Write(held.body.Bytes())
+}
+
+// Wait until a majority of PEERS, this server included, applied the registry up to seq, giving
+// up after REPLICATION_WAIT or when this server stops being the primary
+func waitForMajority(seq uint64) bool {
+	timeout := time.NewTimer(replicationWait)
+	defer timeout.Stop()
+	for {
+		replicationMutex.Lock()
+		leading := currentPrimary == selfURL
+		applied := 1
+		for _, peer := range peers {
+			if peer.Acked >= seq {
+				applied++
+			}
+		}
+		acked := replicationAcked
+		replicationMutex.Unlock()
+
+		if !leading {
+			return false
+		}
+		if applied > len(peerURLs)/2 {
+			return true
+		}
+		select {
+		case <-acked:
+		case <-timeout.C:
+			return false
+		}
+	}
+}
+
+// Forward node control calls to the primary when this server is a backup; on the primary, only
+// answer once a majority of PEERS holds the changes the call made
+func withPrimaryForwarding(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = withPeerVerification(r)
+		if !replicationEnabled() {
+			next(w, r)
+			return
+		}
+		if isPrimary() {
+			mutex.RLock()
+			before := registrySeq
+			mutex.RUnlock()
+			held := &heldResponse{header: make(http.Header), statusCode: http.StatusOK}
+			next(held, r)
+			mutex.RLock()
+			after := registrySeq
+			mutex.RUnlock()
+			if after > before && !waitForMajority(after) {
+				http.Error(w, "Registry change not confirmed by a majority of main servers", http.StatusServiceUnavailable)
+				return
+			}
+			held.release(w)
+			return
+		}
+
+		replicationMutex.Lock()
+		primary := currentPrimary
+		replicationMutex.Unlock()
+		if primary == "" {
+			http.Error(w, "No primary main server available", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		req, err := http.NewRequest(r.Method, primary+r.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, "Error forwarding to primary", http.StatusInternalServerError)
+			return
+		}
+		for _, header := range []string{"Content-Type", "X-Node-Key-Id", "X-Node-Timestamp", "X-Node-Signature"} {
+			if value := r.Header.Get(header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+		// The primary cannot see our TLS session, so vouch for the certificate identity
+		if identity, ok := certificateIdentity(r); ok {
+			req.Header.Set("X-Forwarded-Node-Identity", identity.NodeID+" "+identity.KeyID)
+		}
+		signPeerRequest(req, body)
+
+		resp, err := peerClient.Do(req)
+		if err != nil {
+			http.Error(w, "Primary main server unreachable", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
+
+// Identity a backup vouched for when forwarding an mTLS call
+func forwardedIdentity(r *http.Request) (nodeIdentity, bool) {
+	value := r.Header.Get("X-Forwarded-Node-Identity")
+	if value == "" || !fromPeer(r) {
+		return nodeIdentity{}, false
+	}
+	nodeID, keyID, _ := strings.Cut(value, " ")
+	return nodeIdentity{NodeID: nodeID, KeyID: keyID}, nodeID != ""
+}
+
+// Replica Status Handler (sequence number, term and primary as seen by this server)
+func replicaStatusHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	seq := registrySeq
+	mutex.RUnlock()
+	replicationMutex.Lock()
+	status := replicationReply{Seq: seq, Term: replicationTerm, Primary: termPrimary, Reaches: inTouchWithPrimary()}
+	replicationMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Check a replication call against this server's term, following a primary that leads a newer
+// one; a term is led by the first primary heard from (caller holds replicationMutex)
+func acceptReplication(envelope replicationEnvelope) bool {
+	if envelope.Term < replicationTerm || envelope.Primary == "" {
+		return false
+	}
+	if envelope.Term == replicationTerm && termPrimary != "" && termPrimary != envelope.Primary {
+		return false // Another server already leads this term
+	}
+	if envelope.Term > replicationTerm || currentPrimary != envelope.Primary {
+		logToActiveLog("Following primary", map[string]interface{}{"primary": envelope.Primary, "term": envelope.Term})
+	}
+	replicationTerm, termPrimary, currentPrimary = envelope.Term, envelope.Primary, envelope.Primary
+	return true
+}
+
+// Answer a replication call with this server's sequence number and term
+func writeReplicationReply(w http.ResponseWriter, statusCode int, seq uint64) {
+	replicationMutex.Lock()
+	reply := replicationReply{Seq: seq, Term: replicationTerm, Primary: termPrimary}
+	replicationMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// Replica Append Handler (apply records streamed by the primary, in order)
+func replicaAppendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		replicationEnvelope
+		Records []registryRecord `json:"records"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Records only extend a registry from the same term; a new primary starts with a snapshot
+	replicationMutex.Lock()
+	accepted := request.Term == replicationTerm && acceptReplication(request.replicationEnvelope)
+	replicationMutex.Unlock()
+	mutex.Lock()
+	if !accepted {
+		seq := registrySeq
+		mutex.Unlock()
+		writeReplicationReply(w, http.StatusConflict, seq)
+		return
+	}
+	statusCode := http.StatusOK
+	for _, record := range request.Records {
+		if record.Seq <= registrySeq {
+			continue // Already applied
+		}
+		if record.Seq != registrySeq+1 {
+			statusCode = http.StatusConflict // Gap; the primary resends from our sequence number
+			break
+		}
+		applyRecord(record)
+		if !record.Volatile {
+			appendJournal(record)
+		}
+		registrySeq = record.Seq
+		queueReplication(record)
+	}
+	seq := registrySeq
+	mutex.Unlock()
+	writeReplicationReply(w, statusCode, seq)
+}
+
+// Replica Install Handler (replace the whole registry with the primary's snapshot)
+func replicaInstallHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		replicationEnvelope
+		Snapshot registrySnapshot `json:"snapshot"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	replicationMutex.Lock()
+	sameTerm := request.Term == replicationTerm
+	accepted := acceptReplication(request.replicationEnvelope)
+	replicationMutex.Unlock()
+
+	// Within a term the registry only moves forward, so an older snapshot is a replay or a stale resend
+	mutex.Lock()
+	if !accepted || (sameTerm && request.Snapshot.Seq <= registrySeq) {
+		seq := registrySeq
+		mutex.Unlock()
+		writeReplicationReply(w, http.StatusConflict, seq)
+		return
+	}
+	installSnapshot(request.Snapshot)
+	seq := registrySeq
+	mutex.Unlock()
+	writeReplicationReply(w, http.StatusOK, seq)
+}
+
+// Replica Snapshot Handler (the full registry, for a server taking over as primary)
+func replicaSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	snapshot := currentSnapshot()
+	mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// The registry as a snapshot (caller holds mutex)
+func currentSnapshot() registrySnapshot {
+	replicationMutex.Lock()
+	term := replicationTerm
+	replicationMutex.Unlock()
+	snapshot := registrySnapshot{SavedAt: time.Now(), Seq: registrySeq, Term: term, Nodes: make([]Node, 0, len(nodes))}
+	for _, node := range nodes {
+		snapshot.Nodes = append(snapshot.Nodes, node)
+	}
+	return snapshot
+}
+
+// Replace the registry with a snapshot from another server and persist it (caller holds mutex)
+func installSnapshot(snapshot registrySnapshot) {
+	kept := make(map[string]bool, len(snapshot.Nodes))
+	for _, node := range snapshot.Nodes {
+		kept[node.ID] = true
+	}
+	for id := range nodes {
+		if !kept[id] {
+			removeNode(id) // Drops breakers and assignments of nodes the primary no longer has
+		}
+	}
+	nodes = make(map[string]Node, len(snapshot.Nodes))
+	nodeIndex = newSpatialIndex()
+	for _, node := range snapshot.Nodes {
+		putNode(node)
+	}
+	probes = make(map[string]ProbeResult)
+	registrySeq = snapshot.Seq
+	replicationLog = nil
+	if err := writeSnapshot(); err != nil {
+		log.Printf("Error writing registry snapshot: %v\n", err)
+	}
+	logToActiveLog("Registry installed from peer", fmt.Sprintf("%d nodes at seq %d", len(nodes), registrySeq))
+}
+
+// Start replication: watch the peers, elect the primary and stream records to the backups
+func startReplication() {
+	if selfURL == "" || len(replicationKey) == 0 {
+		log.Fatalf("PEERS requires SELF_URL and REPLICATION_KEY")
+	}
+	found := false
+	for _, peerURL := range peerURLs {
+		if peerURL == selfURL {
+			found = true
+			continue
+		}
+		peer := &peerState{NeedsInstall: true, Wake: make(chan struct{}, 1)}
+		peers[peerURL] = peer
+		go replicateTo(peerURL, peer)
+	}
+	if !found {
+		log.Fatalf("SELF_URL %s is not listed in PEERS", selfURL)
+	}
+	go monitorPeers()
+}
+
+// Periodically check the peers and re-elect the primary
+func monitorPeers() {
+	ticker := time.NewTicker(peerCheckInterval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		for peerURL, peer := range peers {
+			var status replicationReply
+			statusCode, err := callPeer(http.MethodGet, peerURL, "/replica/status", nil, &status)
+			alive := err == nil && statusCode == http.StatusOK
+
+			replicationMutex.Lock()
+			if alive && !peer.Alive {
+				peer.NeedsInstall = true // Whatever it missed, start it from a full snapshot
+				logToActiveLog("Peer reachable", peerURL)
+			} else if !alive && peer.Alive {
+				logToActiveLog("Peer unreachable", peerURL)
+			}
+			peer.Alive = alive
+			if alive {
+				peer.Term, peer.Primary, peer.Reaches = status.Term, status.Primary, status.Reaches
+				if currentPrimary != selfURL {
+					peer.Seq = status.Seq
+				}
+			}
+			replicationMutex.Unlock()
+		}
+
+		replicationMutex.Lock()
+		elected := electPrimary()
+		previous := currentPrimary
+		replicationMutex.Unlock()
+
+		if elected == previous {
+			continue
+		}
+		if elected == selfURL {
+			promote()
+		} else {
+			replicationMutex.Lock()
+			currentPrimary = elected
+			replicationMutex.Unlock()
+		}
+		replicationMutex.Lock()
+		term := replicationTerm
+		replicationMutex.Unlock()
+		switch elected {
+		case "":
+			fmt.Println("No primary main server: fewer than a majority of PEERS reachable")
+			logToActiveLog("Primary lost", "fewer than a majority of PEERS reachable")
+		case selfURL:
+			fmt.Printf("This server is now the primary (term %d)\n", term)
+			logToActiveLog("Primary elected", map[string]interface{}{"primary": elected, "term": term})
+		default:
+			fmt.Printf("Primary main server is now %s\n", elected)
+			logToActiveLog("Primary elected", elected)
+		}
+	}
+}
+
+// Check whether this server leads its term or reaches the server that does (caller holds replicationMutex)
+func inTouchWithPrimary() bool {
+	if termPrimary == selfURL {
+		return true
+	}
+	peer, ok := peers[termPrimary]
+	return ok && peer.Alive
+}
+
+// Pick the primary (caller holds replicationMutex): nobody without a majority of PEERS in reach,
+// so a partitioned minority never elects its own. Otherwise the primary of the newest term known
+// here or to a reachable peer, as long as this server or a reachable peer is in touch with it,
+// even when this server cannot reach it itself; so a server cut off from the primary alone does
+// not depose it. Only when no primary is in touch with anyone here is the first reachable server
+// in PEERS order chosen, which then starts a new term
+func electPrimary() string {
+	reachable := 1
+	for _, peer := range peers {
+		if peer.Alive {
+			reachable++
+		}
+	}
+	if reachable <= len(peerURLs)/2 {
+		return ""
+	}
+
+	leader, leaderTerm := "", uint64(0)
+	if termPrimary != "" && inTouchWithPrimary() {
+		leader, leaderTerm = termPrimary, replicationTerm
+	}
+	for _, peerURL := range peerURLs {
+		peer, ok := peers[peerURL]
+		if !ok || !peer.Alive || !peer.Reaches || peer.Primary == "" {
+			continue
+		}
+		if peer.Term > leaderTerm {
+			leader, leaderTerm = peer.Primary, peer.Term
+		}
+	}
+	if leader != "" {
+		return leader
+	}
+	for _, peerURL := range peerURLs {
+		if peerURL == selfURL || peers[peerURL].Alive {
+			return peerURL
+		}
+	}
+	return ""
+}
+
+// Stop acting as primary after a backup reported a newer term or another primary for ours, and
+// follow the server that leads it
+func stepDown(reply replicationReply) {
+	replicationMutex.Lock()
+	if reply.Term >= replicationTerm && reply.Primary != "" {
+		replicationTerm, termPrimary = reply.Term, reply.Primary
+	}
+	wasPrimary := currentPrimary == selfURL
+	if wasPrimary {
+		currentPrimary = ""
+		if termPrimary != selfURL {
+			currentPrimary = termPrimary
+		}
+	}
+	replicationMutex.Unlock()
+	if wasPrimary {
+		fmt.Printf("Stepping down: %s leads term %d\n", reply.Primary, reply.Term)
+		logToActiveLog("Primary stepped down", map[string]interface{}{"primary": reply.Primary, "term": reply.Term})
+	}
+}
+
+// Take over as primary in a new term: catch up from the most up-to-date peer and give every node a fresh lease
+func promote() {
+	replicationMutex.Lock()
+	bestURL, bestTerm, bestSeq := "", uint64(0), uint64(0)
+	for peerURL, peer := range peers {
+		if !peer.Alive {
+			continue
+		}
+		if peer.Term > bestTerm || (peer.Term == bestTerm && peer.Seq > bestSeq) {
+			bestURL, bestTerm, bestSeq = peerURL, peer.Term, peer.Seq
+		}
+	}
+	ownTerm := replicationTerm
+	replicationMutex.Unlock()
+
+	mutex.RLock()
+	ownSeq := registrySeq
+	mutex.RUnlock()
+	if bestURL != "" && (bestTerm > ownTerm || (bestTerm == ownTerm && bestSeq > ownSeq)) {
+		var snapshot registrySnapshot
+		if statusCode, err := callPeer(http.MethodGet, bestURL, "/replica/snapshot", nil, &snapshot); err != nil || statusCode != http.StatusOK {
+			log.Printf("Error catching up from %s before taking over: %v (status %d)\n", bestURL, err, statusCode)
+		} else {
+			mutex.Lock()
+			installSnapshot(snapshot)
+			mutex.Unlock()
+		}
+	}
+
+	// Start the new term, taking the primary role in the same step so nobody sees one without the other
+	mutex.Lock()
+	replicationMutex.Lock()
+	newTerm := replicationTerm
+	for _, peer := range peers {
+		newTerm = max(newTerm, peer.Term)
+		peer.Acked, peer.NeedsInstall = 0, true
+	}
+	replicationTerm, termPrimary, currentPrimary = newTerm+1, selfURL, selfURL
+	replicationMutex.Unlock()
+
+	// Heartbeats went to the old primary, so restart every lease from now
+	now := time.Now()
+	for _, node := range nodes {
+		node.LastHeartbeat = now
+		putNode(node)
+	}
+	if err := writeSnapshot(); err != nil { // Keep the new term across restarts
+		log.Printf("Error writing registry snapshot: %v\n", err)
+	}
+	mutex.Unlock()
+}
+
+// Stream committed records to one backup while this server is the primary
+func replicateTo(peerURL string, peer *peerState) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-peer.Wake:
+		case <-ticker.C:
+		}
+
+		replicationMutex.Lock()
+		active := currentPrimary == selfURL && peer.Alive
+		needsInstall := peer.NeedsInstall
+		peerSeq := peer.Seq
+		envelope := replicationEnvelope{Term: replicationTerm, Primary: selfURL}
+		replicationMutex.Unlock()
+		if !active {
+			continue
+		}
+
+		mutex.RLock()
+		var batch []registryRecord
+		if !needsInstall && peerSeq < registrySeq {
+			// Fall back to a snapshot when the records the peer needs are no longer kept
+			if len(replicationLog) == 0 || replicationLog[0].Seq > peerSeq+1 {
+				needsInstall = true
+			} else {
+				start := sort.Search(len(replicationLog), func(i int) bool { return replicationLog[i].Seq > peerSeq })
+				batch = append(batch, replicationLog[start:min(start+500, len(replicationLog))]...)
+			}
+		}
+		var snapshot registrySnapshot
+		if needsInstall {
+			snapshot = currentSnapshot()
+		}
+		mutex.RUnlock()
+
+		var result replicationReply
+		var statusCode int
+		var err error
+		if needsInstall {
+			statusCode, err = callPeer(http.MethodPost, peerURL, "/replica/install", map[string]interface{}{"term": envelope.Term, "primary": envelope.Primary, "snapshot": snapshot}, &result)
+		} else if len(batch) > 0 {
+			statusCode, err = callPeer(http.MethodPost, peerURL, "/replica/append", map[string]interface{}{"term": envelope.Term, "primary": envelope.Primary, "records": batch}, &result)
+		} else {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error replicating to %s: %v\n", peerURL, err)
+			continue
+		}
+		if result.Term > envelope.Term || (result.Term == envelope.Term && result.Primary != "" && result.Primary != selfURL) {
+			stepDown(result)
+			continue
+		}
+
+		replicationMutex.Lock()
+		switch {
+		case statusCode == http.StatusOK:
+			peer.NeedsInstall = false
+			peer.Seq, peer.Acked = result.Seq, result.Seq
+			close(replicationAcked)
+			replicationAcked = make(chan struct{})
+		case statusCode == http.StatusConflict && result.Term < envelope.Term:
+			peer.NeedsInstall = true // The peer has not joined this term yet
+		case statusCode == http.StatusConflict:
+			peer.Seq = result.Seq // Resume from where the peer actually is
+			if needsInstall && result.Seq >= snapshot.Seq {
+				peer.NeedsInstall = false // It already holds this snapshot
+			}
+		default:
+			log.Printf("Replication to %s rejected. Status code: %d\n", peerURL, statusCode)
+		}
+		replicationMutex.Unlock()
+	}
+}
+
+// Number of peers handed to a registering node to seed its gossip membership
+var gossipSeedCount = envInt("GOSSIP_SEEDS", 10)
+
+// Peer entry in the registration response
+type gossipSeed struct {
+	ID        string  `json:"id"`
+	IPAddress string  `json:"ip_address"`
+	Port      string  `json:"port"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Region    string  `json:"region,omitempty"`
+	Zone      string  `json:"zone,omitempty"`
+}
+
+// The active nodes nearest to a registering node (caller holds mutex)
+func gossipSeeds(node Node) []gossipSeed {
+	ids := nodeIndex.nearest(node.Latitude, node.Longitude, gossipSeedCount, func(id string) bool {
+		return id != node.ID && nodes[id].Status == "active"
+	})
+
+	seeds := make([]gossipSeed, 0, len(ids))
+	for _, id := range ids {
+		other := nodes[id]
+		seeds = append(seeds, gossipSeed{
+			ID:        other.ID,
+			IPAddress: other.IPAddress,
+			Port:      other.Port,
+			Latitude:  other.Latitude,
+			Longitude: other.Longitude,
+			Region:    other.Region,
+			Zone:      other.Zone,
+		})
+	}
+	return seeds
+}
+
+// Drain Node Handler (stop sending new clients to a node that is shutting down)
+func drainNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ID string `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.ID, err = resolveNodeID(r, request.ID); err != nil {
+		rejectNodeRequest(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if request.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	node, exists := nodes[request.ID]
+	if exists && node.KeyID != authenticatedKeyID(r) {
+		mutex.Unlock()
+		rejectNodeRequest(w, r, "drain signed with another node's key", http.StatusForbidden)
+		return
+	}
+	if exists {
+		node.Draining = true
+		node = updateStatus(node, time.Now())
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Node not registered", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]string{
+		"message": "Node draining",
+		"node_id": node.ID,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Deregister Node Handler (remove a node from the registry, via POST body or DELETE ?id=)
+func deregisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID string `json:"id"`
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		request.ID = r.URL.Query().Get("id")
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	if request.ID, err = resolveNodeID(r, request.ID); err != nil {
+		rejectNodeRequest(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if request.ID == "" {
+		http.Error(w, "Missing node ID", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	node, exists := nodes[request.ID]
+	if exists && node.KeyID != authenticatedKeyID(r) {
+		mutex.Unlock()
+		rejectNodeRequest(w, r, "deregistration signed with another node's key", http.StatusForbidden)
+		return
+	}
+	if exists {
+		removeNode(node.ID)
+		journalDelete(node.ID)
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Node not registered", http.StatusNotFound)
+		return
+	}
+
+	logToActiveLog("Node deregistered", node)
+	fmt.Printf("Node deregistered: %s\n", node.ID)
+
+	response := map[string]string{
+		"message": "Node deregistered successfully",
+		"node_id": node.ID,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Periodically expire node leases: flag silent nodes as suspect/down and evict them after the TTL
+func monitorLeases() {
+	ticker := time.NewTicker(heartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if isPrimary() {
+			expireLeases(time.Now())
+		}
+	}
+}
+
+// Apply the lease rules to every registered node
+func expireLeases(now time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for id, node := range nodes {
+		silence := now.Sub(node.LastHeartbeat)
+		if silence > evictAfter {
+			removeNode(id)
+			journalDelete(id)
+			logToActiveLog("Node evicted", node)
+			fmt.Printf("Node evicted after %v without heartbeat: %s\n", silence.Round(time.Second), id)
+			continue
+		}
+
+		updateStatus(node, now)
+	}
+}
+
+// Work out a node's routing status from its lease and its latest probes (caller holds mutex)
+func deriveStatus(node Node, now time.Time) string {
+	missed := int(now.Sub(node.LastHeartbeat) / heartbeatInterval)
+	if missed >= downAfterMisses {
+		return "down"
+	}
+	if node.Draining {
+		return "draining"
+	}
+	if !node.Verified {
+		return "unverified"
+	}
+	if probe, ok := probes[node.ID]; ok && !probe.Reachable {
+		return "unreachable"
+	}
+	if missed >= suspectAfterMisses {
+		return "suspect"
+	}
+	return "active"
+}
+
+// Recompute a node's status, store it, journal any change and log any transition (caller holds mutex)
+func updateStatus(node Node, now time.Time) Node {
+	previous, stored := nodes[node.ID]
+	status := deriveStatus(node, now)
+	changed := status != node.Status
+	node.Status = status
+	putNode(node)
+	if !stored || changedBeyondLease(previous, node) {
+		journalPut(node) // Drain and verification flags matter after a restart or failover too
+	}
+	if changed {
+		logToActiveLog("Node marked "+status, node)
+	}
+	return node
+}
+
+// Check whether a node entry changed in anything but its lease and load, which heartbeats
+// replicate without journaling
+func changedBeyondLease(previous, node Node) bool {
+	previous.LastHeartbeat, previous.Load = node.LastHeartbeat, node.Load
+	return !reflect.DeepEqual(previous, node)
+}
+
+// Base URL for reaching a node: registered URLs are used as-is, bare addresses get the node's port
+func nodeBaseURL(node Node) string {
+	if strings.Contains(node.IPAddress, "://") {
+		return strings.TrimRight(node.IPAddress, "/")
+	}
+	return "http://" + net.JoinHostPort(node.IPAddress, node.Port)
+}
+
+// Periodically probe the /health endpoint of every registered node
+func probeNodes() {
+	client := &http.Client{Timeout: probeTimeout}
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	// Probe right away so nodes restored from disk are verified quickly
+	for ; ; <-ticker.C {
+		if !isPrimary() {
+			continue // Backups take statuses from the primary
+		}
+
+		mutex.RLock()
+		targets := make([]Node, 0, len(nodes))
+		for _, node := range nodes {
+			targets = append(targets, node)
+		}
+		mutex.RUnlock()
+
+		var wg sync.WaitGroup
+		for _, node := range targets {
+			wg.Add(1)
+			go func(node Node) {
+				defer wg.Done()
+				probeNode(client, node)
+			}(node)
+		}
+		wg.Wait()
+	}
+}
+
+// Probe a single node and record the outcome
+func probeNode(client *http.Client, node Node) {
+	start := time.Now()
+	resp, err := client.Get(nodeBaseURL(node) + "/health")
+	rtt := time.Since(start)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+	}
+
+	recordProbe(node.ID, start, rtt, err)
+	recordOutcome(node.ID, "probe", err)
+}
+
+// Update a node's probe history, applying hysteresis before flipping reachability
+func recordProbe(nodeID string, probedAt time.Time, rtt time.Duration, probeErr error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	node, exists := nodes[nodeID]
+	if !exists {
+		return // Evicted while the probe was in flight
+	}
+
+	probe, seen := probes[nodeID]
+	if !seen {
+		probe.Reachable = true // New nodes get the benefit of the doubt
+	}
+	probe.LastProbe = probedAt
+	probe.LastRTTMillis = float64(rtt.Microseconds()) / 1000
+
+	if probeErr != nil {
+		probe.LastError = probeErr.Error()
+		probe.ConsecutiveFailures++
+		probe.ConsecutiveSuccesses = 0
+		if probe.ConsecutiveFailures >= probeFailureThreshold {
+			probe.Reachable = false
+		}
+	} else {
+		node.Verified = true
+		probe.LastError = ""
+		probe.ConsecutiveSuccesses++
+		probe.ConsecutiveFailures = 0
+		if probe.ConsecutiveSuccesses >= probeRecoveryThreshold {
+			probe.Reachable = true
+		}
+	}
+	probes[nodeID] = probe
+
+	updateStatus(node, time.Now())
+}
+
+// Circuit breaker settings (per node, fed by notification, probe and proxy outcomes)
+var (
+	breakerFailureThreshold = envInt("BREAKER_FAILURE_THRESHOLD", 5)          // Consecutive failures that open a node's breaker
+	breakerCooldown         = envDuration("BREAKER_COOLDOWN", 30*time.Second) // How long an open breaker keeps the node out of routing
+	breakerTrialSuccesses   = envInt("BREAKER_TRIAL_SUCCESSES", 2)            // Successes while half-open that close the breaker again
+	breakerTrialRequests    = envInt("BREAKER_TRIAL_REQUESTS", 1)             // Requests routed to a half-open node at a time
+	notifyTimeout           = envDuration("NOTIFY_TIMEOUT", 5*time.Second)    // Time allowed for a redirect notification
+	notifyClient            = &http.Client{Timeout: notifyTimeout}
+)
+
+// Breaker state of one node: "closed" (routed normally), "open" (skipped until the cool-down ends)
+// or "half-open" (routed again on trial, a few requests at a time; one failure reopens it)
+type CircuitBreaker struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	TrialSuccesses      int        `json:"trial_successes,omitempty"`
+	TrialsInFlight      int        `json:"trials_in_flight,omitempty"` // Trial requests routed to the node that have not reported back
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastFailure         string     `json:"last_failure,omitempty"` // Source ("notify", "probe", "proxy") and error of the latest failure
+	trialClaimedAt      time.Time  // When the latest trial permit was handed out
+}
+
+var (
+	breakers     = make(map[string]*CircuitBreaker) // Breakers by node ID; nodes without an entry are closed
+	breakerMutex = &sync.Mutex{}
+)
+
+// Feed the outcome of a call to a node into its breaker
+func recordOutcome(nodeID string, source string, callErr error) {
+	breakerMutex.Lock()
+	breaker, exists := breakers[nodeID]
+	if !exists {
+		if callErr == nil {
+			breakerMutex.Unlock()
+			return // Nothing to remember for a healthy node
+		}
+		breaker = &CircuitBreaker{State: "closed"}
+		breakers[nodeID] = breaker
+	}
+
+	previous := breaker.State
+	if breaker.State == "half-open" && source != "probe" && breaker.TrialsInFlight > 0 {
+		breaker.TrialsInFlight-- // A trial request reported back, freeing its permit
+	}
+	if callErr != nil {
+		breaker.ConsecutiveFailures++
+		breaker.TrialSuccesses = 0
+		breaker.LastFailure = source + ": " + callErr.Error()
+		if breaker.State == "half-open" || (breaker.State == "closed" && breaker.ConsecutiveFailures >= breakerFailureThreshold) {
+			openedAt := time.Now()
+			breaker.State = "open"
+			breaker.OpenedAt = &openedAt
+			breaker.TrialsInFlight = 0
+		}
+	} else {
+		breaker.ConsecutiveFailures = 0
+		if breaker.State == "half-open" {
+			breaker.TrialSuccesses++
+			if breaker.TrialSuccesses >= breakerTrialSuccesses {
+				breaker.State = "closed"
+			}
+		}
+		if breaker.State == "closed" {
+			delete(breakers, nodeID)
+		}
+	}
+	state, lastFailure := breaker.State, breaker.LastFailure
+	breakerMutex.Unlock()
+
+	if state != previous {
+		logToActiveLog("Circuit breaker "+state, map[string]string{"node_id": nodeID, "last_failure": lastFailure})
+		fmt.Printf("Circuit breaker for node %s is now %s\n", nodeID, state)
+	}
+}
+
+// Check whether a node's breaker keeps it out of routing: open and still cooling down, or
+// half-open with every trial permit taken. The breaker itself is left as it is.
+func breakerOpen(nodeID string, now time.Time) bool {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	breaker, exists := breakers[nodeID]
+	return exists && !breakerAdmits(breaker, now)
+}
+
+// Check whether a breaker lets another request through (caller holds breakerMutex)
+func breakerAdmits(breaker *CircuitBreaker, now time.Time) bool {
+	switch breaker.State {
+	case "closed":
+		return true
+	case "open":
+		return now.Sub(*breaker.OpenedAt) >= breakerCooldown
+	}
+	// Permits of trial requests that never reported back lapse after a cool-down
+	return breaker.TrialsInFlight < breakerTrialRequests || now.Sub(breaker.trialClaimedAt) >= breakerCooldown
+}
+
+// Claim the right to send a request to a node, just before it is routed there. Closed breakers
+// always allow it; half-open ones hand out BREAKER_TRIAL_REQUESTS permits at a time. An open
+// breaker whose cool-down is over turns half-open here, with the first trial request.
+func claimBreakerTrial(nodeID string, now time.Time) bool {
+	breakerMutex.Lock()
+	breaker, exists := breakers[nodeID]
+	if !exists || breaker.State == "closed" {
+		breakerMutex.Unlock()
+		return true
+	}
+	if !breakerAdmits(breaker, now) {
+		breakerMutex.Unlock()
+		return false
+	}
+	previous := breaker.State
+	if previous == "open" || now.Sub(breaker.trialClaimedAt) >= breakerCooldown {
+		breaker.TrialsInFlight = 0
+	}
+	if previous == "open" {
+		breaker.State = "half-open"
+		breaker.TrialSuccesses = 0
+	}
+	breaker.TrialsInFlight++
+	breaker.trialClaimedAt = now
+	breakerMutex.Unlock()
+
+	if previous == "open" {
+		logToActiveLog("Circuit breaker half-open", map[string]string{"node_id": nodeID})
+		fmt.Printf("Circuit breaker for node %s is now half-open\n", nodeID)
+	}
+	return true
+}
+
+// Hand back a trial permit when the request did not go to the node after all
+func releaseBreakerTrial(nodeID string) {
+	breakerMutex.Lock()
+	if breaker, exists := breakers[nodeID]; exists && breaker.State == "half-open" && breaker.TrialsInFlight > 0 {
+		breaker.TrialsInFlight--
+	}
+	breakerMutex.Unlock()
+}
+
+// Nodes whose breaker is open and still cooling down, without moving any breaker to half-open
+func openBreakers(now time.Time) map[string]bool {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	open := make(map[string]bool)
+	for id, breaker := range breakers {
+		if breaker.State == "open" && now.Sub(*breaker.OpenedAt) < breakerCooldown {
+			open[id] = true
+		}
+	}
+	return open
+}
+
+// Copy of a node's breaker for the query APIs, or nil while it is closed
+func breakerState(nodeID string) *CircuitBreaker {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	breaker, exists := breakers[nodeID]
+	if !exists {
+		return nil
+	}
+	copied := *breaker
+	return &copied
+}
+
+// Forget the breaker of a node that left the registry
+func forgetBreaker(nodeID string) {
+	breakerMutex.Lock()
+	delete(breakers, nodeID)
+	breakerMutex.Unlock()
+}
+
+// Registry entry as returned by the query API
+type nodeView struct {
+	Node
+	DistanceKm *float64        `json:"distance_km,omitempty"`
+	Probe      *ProbeResult    `json:"probe,omitempty"`
+	Breaker    *CircuitBreaker `json:"breaker,omitempty"` // Present while the breaker is open or half-open
+}
+
+// List Nodes Handler (GET /nodes with optional status, bbox, radius and pagination filters)
+//
+//	status=active,suspect               only nodes with one of these statuses
+//	bbox=minLat,minLon,maxLat,maxLon    only nodes inside the box (minLon > maxLon crosses the antimeridian)
+//	lat=..&lon=..&radius_km=..          only nodes within the radius, sorted by distance
+//	capability=..&tag=..&region=..      only nodes offering these capabilities/tags, in this region
+//	limit=..&offset=..                  page through the results (default limit 100, max 1000)
+func listNodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	statuses := make(map[string]bool)
+	if value := query.Get("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			statuses[strings.TrimSpace(status)] = true
+		}
+	}
+
+	var bbox []float64
+	if value := query.Get("bbox"); value != "" {
+		parts := strings.Split(value, ",")
+		if len(parts) != 4 {
+			http.Error(w, "Invalid bbox, expected minLat,minLon,maxLat,maxLon", http.StatusBadRequest)
+			return
+		}
+		for _, part := range parts {
+			number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				http.Error(w, "Invalid bbox value", http.StatusBadRequest)
+				return
+			}
+			bbox = append(bbox, number)
+		}
+	}
+
+	var centerLat, centerLon, radius float64
+	byDistance := query.Get("lat") != "" || query.Get("lon") != "" || query.Get("radius_km") != ""
+	if byDistance {
+		var err error
+		if centerLat, err = strconv.ParseFloat(query.Get("lat"), 64); err != nil {
+			http.Error(w, "Invalid latitude value", http.StatusBadRequest)
+			return
+		}
+		if centerLon, err = strconv.ParseFloat(query.Get("lon"), 64); err != nil {
+			http.Error(w, "Invalid longitude value", http.StatusBadRequest)
+			return
+		}
+		if err := validateCoordinates(centerLat, centerLon); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		radius = math.MaxFloat64
+		if value := query.Get("radius_km"); value != "" {
+			if radius, err = strconv.ParseFloat(value, 64); err != nil || radius < 0 {
+				http.Error(w, "Invalid radius_km value", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	limit, offset := 100, 0
+	if value := query.Get("limit"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 || number > 1000 {
+			http.Error(w, "Invalid limit value (1-1000)", http.StatusBadRequest)
+			return
+		}
+		limit = number
+	}
+	if value := query.Get("offset"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			http.Error(w, "Invalid offset value", http.StatusBadRequest)
+			return
+		}
+		offset = number
+	}
+
+	filter := parseNodeFilter(query)
+
+	mutex.RLock()
+	matches := make([]nodeView, 0, len(nodes))
+	for _, node := range nodes {
+		if len(statuses) > 0 && !statuses[node.Status] {
+			continue
+		}
+		if !filter.matches(node) {
+			continue
+		}
+		if bbox != nil && !insideBoundingBox(node.Latitude, node.Longitude, bbox) {
+			continue
+		}
+		view := nodeView{Node: node}
+		if byDistance {
+			distance := calculateDistance(centerLat, centerLon, node.Latitude, node.Longitude)
+			if distance > radius {
+				continue
+			}
+			view.DistanceKm = &distance
+		}
+		matches = append(matches, view)
+	}
+	mutex.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if byDistance && *matches[i].DistanceKm != *matches[j].DistanceKm {
+			return *matches[i].DistanceKm < *matches[j].DistanceKm
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	total := len(matches)
+	page := matches[min(offset, total):min(offset+limit, total)]
+
+	response := map[string]interface{}{
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+		"nodes":  page,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Check whether a point lies inside minLat,minLon,maxLat,maxLon
+func insideBoundingBox(lat, lon float64, bbox []float64) bool {
+	minLat, minLon, maxLat, maxLon := bbox[0], bbox[1], bbox[2], bbox[3]
+	if lat < minLat || lat > maxLat {
+		return false
+	}
+	if minLon <= maxLon {
+		return lon >= minLon && lon <= maxLon
+	}
+	return lon >= minLon || lon <= maxLon // Box crosses the antimeridian
+}
+
+// Get Node Handler (GET /nodes/{id} with the node's latest probe result)
+func getNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.RLock()
+	node, exists := nodes[r.PathValue("id")]
+	view := nodeView{Node: node}
+	if probe, ok := probes[node.ID]; ok {
+		view.Probe = &probe
+	}
+	if breaker := breakerState(node.ID); breaker != nil {
+		view.Breaker = breaker
+	}
+	mutex.RUnlock()
+
+	if !exists {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+// Probe Status Handler (latest probe results, for one node with ?id= or for all nodes)
+func probeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type probeStatus struct {
+		NodeID  string          `json:"node_id"`
+		Status  string          `json:"status"`
+		Probe   *ProbeResult    `json:"probe,omitempty"`
+		Breaker *CircuitBreaker `json:"breaker,omitempty"`
+	}
+	statusOf := func(node Node) probeStatus {
+		status := probeStatus{NodeID: node.ID, Status: node.Status, Breaker: breakerState(node.ID)}
+		if probe, ok := probes[node.ID]; ok {
+			status.Probe = &probe
+		}
+		return status
+	}
+
+	id := r.URL.Query().Get("id")
+
+	mutex.RLock()
+	var response interface{}
+	if id != "" {
+		node, exists := nodes[id]
+		if !exists {
+			mutex.RUnlock()
+			http.Error(w, "Node not found", http.StatusNotFound)
+			return
+		}
+		response = statusOf(node)
+	} else {
+		statuses := make([]probeStatus, 0, len(nodes))
+		for _, node := range nodes {
+			statuses = append(statuses, statusOf(node))
+		}
+		response = statuses
+	}
+	mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Spatial index: nodes are placed on the unit sphere and bucketed in a two-level grid of
+// cubes over 3D space. A lookup visits cells in order of their smallest possible distance
+// to the client, so it only looks at the nodes near the answer instead of the whole fleet.
+const (
+	indexFineCells   = 64 // Fine cells per axis (about 200 km across at the surface)
+	indexCoarseRatio = 8  // Fine cells per coarse cell per axis
+)
+
+// Point on the unit sphere
+type vec3 struct{ X, Y, Z float64 }
+
+// Cell coordinates in the grid
+type cellKey struct{ X, Y, Z int }
+
+// Index of node positions, guarded by mutex like the nodes map it mirrors
+type spatialIndex struct {
+	cells     map[cellKey]map[cellKey]map[string]vec3 // Coarse cell -> fine cell -> node ID -> position
+	locations map[string]cellKey                      // Fine cell of each node
+}
+
+var nodeIndex = newSpatialIndex()
+
+func newSpatialIndex() *spatialIndex {
+	return &spatialIndex{
+		cells:     make(map[cellKey]map[cellKey]map[string]vec3),
+		locations: make(map[string]cellKey),
+	}
+}
+
+// Convert a latitude/longitude to a point on the unit sphere
+func toUnitVector(lat, lon float64) vec3 {
+	latRad, lonRad := lat*math.Pi/180, lon*math.Pi/180
+	return vec3{math.Cos(latRad) * math.Cos(lonRad), math.Cos(latRad) * math.Sin(lonRad), math.Sin(latRad)}
+}
+
+// Grid cell of a point at the given number of cells per axis
+func cellOf(point vec3, cells int) cellKey {
+	axis := func(v float64) int {
+		i := int((v + 1) / 2 * float64(cells))
+		return max(0, min(cells-1, i))
+	}
+	return cellKey{axis(point.X), axis(point.Y), axis(point.Z)}
+}
+
+// Smallest straight-line distance from a point to any point of a cell
+func cellLowerBound(point vec3, cell cellKey, cells int) float64 {
+	size := 2 / float64(cells)
+	axis := func(v float64, i int) float64 {
+		low := -1 + float64(i)*size
+		return max(low-v, 0, v-(low+size))
+	}
+	dx, dy, dz := axis(point.X, cell.X), axis(point.Y, cell.Y), axis(point.Z, cell.Z)
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+// Straight-line distance between two points on the unit sphere (orders the same as great-circle distance)
+func chordDistance(a, b vec3) float64 {
+	dx, dy, dz := a.X-b.X, a.Y-b.Y, a.Z-b.Z
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+// Add or move a node
+func (index *spatialIndex) put(id string, lat, lon float64) {
+	index.remove(id)
+	point := toUnitVector(lat, lon)
+	fine := cellOf(point, indexFineCells)
+	coarse := cellKey{fine.X / indexCoarseRatio, fine.Y / indexCoarseRatio, fine.Z / indexCoarseRatio}
+	if index.cells[coarse] == nil {
+		index.cells[coarse] = make(map[cellKey]map[string]vec3)
+	}
+	if index.cells[coarse][fine] == nil {
+		index.cells[coarse][fine] = make(map[string]vec3)
+	}
+	index.cells[coarse][fine][id] = point
+	index.locations[id] = fine
+}
+
+// Drop a node, along with cells left empty
+func (index *spatialIndex) remove(id string) {
+	fine, ok := index.locations[id]
+	if !ok {
+		return
+	}
+	coarse := cellKey{fine.X / indexCoarseRatio, fine.Y / indexCoarseRatio, fine.Z / indexCoarseRatio}
+	delete(index.cells[coarse][fine], id)
+	if len(index.cells[coarse][fine]) == 0 {
+		delete(index.cells[coarse], fine)
+	}
+	if len(index.cells[coarse]) == 0 {
+		delete(index.cells, coarse)
+	}
+	delete(index.locations, id)
+}
+
+// Search queue entry: a coarse cell, a fine cell or a node, keyed by its (lower bound) distance
+type indexEntry struct {
+	distance float64
+	coarse   *cellKey
+	fine     *cellKey
+	id       string
+}
+
+type indexQueue []indexEntry
+
+func (q indexQueue) Len() int            { return len(q) }
+func (q indexQueue) Less(i, j int) bool  { return q[i].distance < q[j].distance }
+func (q indexQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *indexQueue) Push(x interface{}) { *q = append(*q, x.(indexEntry)) }
+func (q *indexQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// IDs of the up to count nearest nodes that accept allows, nearest first
+func (index *spatialIndex) nearest(lat, lon float64, count int, accept func(id string) bool) []string {
+	point := toUnitVector(lat, lon)
+	queue := make(indexQueue, 0, len(index.cells))
+	for coarse := range index.cells {
+		coarse := coarse
+		queue = append(queue, indexEntry{distance: cellLowerBound(point, coarse, indexFineCells/indexCoarseRatio), coarse: &coarse})
+	}
+	heap.Init(&queue)
+
+	var result []string
+	for queue.Len() > 0 && len(result) < count {
+		entry := heap.Pop(&queue).(indexEntry)
+		switch {
+		case entry.coarse != nil:
+			for fine := range index.cells[*entry.coarse] {
+				fine := fine
+				heap.Push(&queue, indexEntry{distance: cellLowerBound(point, fine, indexFineCells), fine: &fine})
+			}
+		case entry.fine != nil:
+			coarse := cellKey{entry.fine.X / indexCoarseRatio, entry.fine.Y / indexCoarseRatio, entry.fine.Z / indexCoarseRatio}
+			for id, position := range index.cells[coarse][*entry.fine] {
+				if accept(id) {
+					heap.Push(&queue, indexEntry{distance: chordDistance(point, position), id: id})
+				}
+			}
+		default:
+			result = append(result, entry.id)
+		}
+	}
+	return result
+}
+
+// IDs of the up to count nearest nodes that accept allows, nearest first by another distance measure.
+// The search runs on the sphere as usual, but keeps going until no unvisited node can beat the
+// count-th best: minRatio bounds the measure from below as a share of the spherical distance.
+func (index *spatialIndex) nearestBy(lat, lon float64, count int, accept func(id string) bool, distance func(id string) float64, minRatio float64) []string {
+	const earthRadius = 6371 // km, as in haversineDistance
+	point := toUnitVector(lat, lon)
+	queue := make(indexQueue, 0, len(index.cells))
+	for coarse := range index.cells {
+		coarse := coarse
+		queue = append(queue, indexEntry{distance: cellLowerBound(point, coarse, indexFineCells/indexCoarseRatio), coarse: &coarse})
+	}
+	heap.Init(&queue)
+
+	type found struct {
+		id       string
+		distance float64
+	}
+	var best []found // Sorted by distance, at most count long
+	for queue.Len() > 0 {
+		entry := heap.Pop(&queue).(indexEntry)
+		if len(best) == count {
+			// Chord length to a lower bound of the measure for anything still queued
+			bound := minRatio * earthRadius * 2 * math.Asin(min(entry.distance/2, 1))
+			if bound >= best[count-1].distance {
+				break
+			}
+		}
+		switch {
+		case entry.coarse != nil:
+			for fine := range index.cells[*entry.coarse] {
+				fine := fine
+				heap.Push(&queue, indexEntry{distance: cellLowerBound(point, fine, indexFineCells), fine: &fine})
+			}
+		case entry.fine != nil:
+			coarse := cellKey{entry.fine.X / indexCoarseRatio, entry.fine.Y / indexCoarseRatio, entry.fine.Z / indexCoarseRatio}
+			for id, position := range index.cells[coarse][*entry.fine] {
+				if accept(id) {
+					heap.Push(&queue, indexEntry{distance: chordDistance(point, position), id: id})
+				}
+			}
+		default:
+			candidate := found{entry.id, distance(entry.id)}
+			at := sort.Search(len(best), func(i int) bool { return best[i].distance > candidate.distance })
+			if at < count {
+				best = slices.Insert(best, at, candidate)
+				if len(best) > count {
+					best = best[:count]
+				}
+			}
+		}
+	}
+
+	result := make([]string, len(best))
+	for i, candidate := range best {
+		result[i] = candidate.id
+	}
+	return result
+}
+
+// Store a node and keep the index in step (caller holds mutex)
+func putNode(node Node) {
+	nodes[node.ID] = node
+	nodeIndex.put(node.ID, node.Latitude, node.Longitude)
+}
+
+// Remove a node with its index entry, probes, breaker and client assignments (caller holds mutex)
+func removeNode(id string) {
+	delete(nodes, id)
+	nodeIndex.remove(id)
+	delete(probes, id)
+	forgetBreaker(id)
+	releaseNodeAssignments(id)
+}
+
+// Weights blending distance and utilization into a routing score (lower is better)
+type routingWeights struct {
+	Distance float64 // Per ROUTING_DISTANCE_SCALE_KM of distance
+	CPU      float64 // Per 100% CPU
+	Memory   float64 // Per 100% memory
+	Clients  float64 // Per full node (active clients / capacity)
+}
+
+// Routing settings
+var (
+	routeWeights         = parseRoutingWeights(envString("ROUTING_WEIGHTS", "distance=1,cpu=0.5,memory=0.25,clients=0.5"))
+	routingDistanceScale = envFloat("ROUTING_DISTANCE_SCALE_KM", 1000) // Distance that weighs as much as a fully loaded node
+	routingCandidates    = envInt("ROUTING_CANDIDATES", 8)             // Nearest nodes scored per redirect
+	routingClientScale   = envInt("ROUTING_CLIENT_SCALE", 100)         // Clients that count as a full node when its capacity is unknown
+	saturationCPU        = envFloat("SATURATION_CPU_PERCENT", 90)      // Nodes at or above this CPU are skipped while others are free
+	saturationMemory     = envFloat("SATURATION_MEMORY_PERCENT", 90)   // Same for memory
+	loadReportMaxAge     = 3 * heartbeatInterval                       // Older load reports are ignored
+)
+
+// Parse "distance=1,cpu=0.5,memory=0.25,clients=0.5"; unknown or invalid entries are logged and skipped
+func parseRoutingWeights(value string) routingWeights {
+	parsed := routingWeights{Distance: 1}
+	for _, entry := range strings.Split(value, ",") {
+		name, number, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if !ok || err != nil || weight < 0 {
+			log.Printf("Invalid ROUTING_WEIGHTS entry %q\n", entry)
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "distance":
+			parsed.Distance = weight
+		case "cpu":
+			parsed.CPU = weight
+		case "memory":
+			parsed.Memory = weight
+		case "clients":
+			parsed.Clients = weight
+		default:
+			log.Printf("Unknown ROUTING_WEIGHTS entry %q\n", entry)
+		}
+	}
+	return parsed
+}
+
+// The node's load report, if it is recent enough to route on
+func currentLoad(node Node, now time.Time) (NodeLoad, bool) {
+	if node.Load == nil || now.Sub(node.Load.ReportedAt) > loadReportMaxAge {
+		return NodeLoad{}, false
+	}
+	return *node.Load, true
+}
+
+// Share of the node's client capacity in use
+func clientUtilization(node Node, load NodeLoad) float64 {
+	capacity := node.Capacity
+	if capacity <= 0 {
+		capacity = routingClientScale
+	}
+	if capacity <= 0 {
+		return 0
+	}
+	return math.Min(float64(load.ActiveClients)/float64(capacity), 1)
+}
+
+// Check whether a node should only get clients when every candidate is saturated
+func isSaturated(node Node, now time.Time) bool {
+	load, ok := currentLoad(node, now)
+	if !ok {
+		return false
+	}
+	return load.CPUPercent >= saturationCPU || load.MemoryPercent >= saturationMemory ||
+		(node.Capacity > 0 && load.ActiveClients >= node.Capacity)
+}
+
+// Routing score for sending a client at the given (effective) distance to the node (lower is better)
+func routingScore(node Node, distanceKm float64, now time.Time) float64 {
+	score := routeWeights.Distance * distanceKm / routingDistanceScale
+	if load, ok := currentLoad(node, now); ok {
+		score += routeWeights.CPU*load.CPUPercent/100 + routeWeights.Memory*load.MemoryPercent/100 + routeWeights.Clients*clientUtilization(node, load)
+	}
+	return score
+}
+
+// Candidate node for a client, with what its rank is based on
+type rankedNode struct {
+	Node       Node
+	DistanceKm float64
+	RTTMillis  *float64 // Measured RTT from the client's area, if known
+	Score      float64
+	Saturated  bool
+}
+
+// RoutingStrategy ranks the nodes a client may be sent to, best first.
+// Rank reads the nodes in request.Fleet; for the live registry it is called with the registry read lock held.
+type RoutingStrategy interface {
+	Name() string
+	Rank(request routingRequest) []rankedNode
+}
+
+// What a strategy ranks nodes for
+type routingRequest struct {
+	Lat, Lon float64
+	Filter   nodeFilter
+	Count    int // Nodes wanted; strategies may return more
+	Now      time.Time
+	Fleet    fleetView // Nodes to choose from
+	Model    string    // Distance model
+}
+
+// Distance from the client to a node with the request's model
+func (request routingRequest) distance(node Node) float64 {
+	return distanceWith(request.Model, request.Lat, request.Lon, node.Latitude, node.Longitude)
+}
+
+// IDs of the up to count accepted nodes nearest to the client by the request's model, nearest first
+func (request routingRequest) nearest(count int, accept func(id string) bool) []string {
+	if request.Model != "vincenty" {
+		return request.Fleet.Index.nearest(request.Lat, request.Lon, count, accept)
+	}
+	return request.Fleet.Index.nearestBy(request.Lat, request.Lon, count, accept, func(id string) float64 {
+		return request.distance(request.Fleet.Nodes[id])
+	}, ellipsoidMinRatio)
+}
+
+// Nodes a strategy ranks from: the live registry, or a hypothetical fleet in simulations
+type fleetView struct {
+	Nodes     map[string]Node
+	Index     *spatialIndex
+	Simulated bool            // Hypothetical fleet: breakers come from Open and measured latencies are ignored
+	Open      map[string]bool // Nodes whose breaker was open when the simulation started
+}
+
+// Check whether a node's breaker keeps it out of the ranking. Simulations read their snapshot
+// of the breakers instead.
+func (request routingRequest) breakerOpen(id string) bool {
+	if request.Fleet.Simulated {
+		return request.Fleet.Open[id]
+	}
+	return breakerOpen(id, request.Now)
+}
+
+// The live registry (caller holds mutex)
+func liveFleet() fleetView {
+	return fleetView{Nodes: nodes, Index: nodeIndex}
+}
+
+// Built-in strategies by name
+var routingStrategies = map[string]RoutingStrategy{
+	"weighted":       weightedStrategy{},
+	"haversine":      haversineStrategy{},
+	"least-load":     leastLoadStrategy{},
+	"round-robin":    &roundRobinStrategy{},
+	"random":         randomStrategy{},
+	"follow-the-sun": followTheSunStrategy{},
+}
+
+// Strategy settings
+var (
+	defaultStrategyName = envString("ROUTING_STRATEGY", "weighted")
+	routingRadius       = envFloat("ROUTING_RADIUS_KM", 2000)       // Area least-load, round-robin and random choose from
+	routingRadiusNodes  = envInt("ROUTING_RADIUS_MAX_NODES", 200)   // Most nodes considered within that area
+	followTheSunHours   = envString("FOLLOW_THE_SUN_HOURS", "8-20") // Local solar hours follow-the-sun prefers
+	tenantStrategies    = make(map[string]string)                   // Strategy name by tenant, from ROUTING_TENANTS_FILE
+)
+
+// Load the per-tenant strategy table ({"tenant": "strategy"}), if there is one
+func loadTenantStrategies() error {
+	path := envString("ROUTING_TENANTS_FILE", filepath.Join(registryFolder, "routing_tenants.json"))
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var table map[string]string
+	if err := json.Unmarshal(data, &table); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for tenant, name := range table {
+		if _, ok := routingStrategies[name]; !ok {
+			log.Printf("Ignoring unknown routing strategy %q for tenant %q\n", name, tenant)
+			continue
+		}
+		tenantStrategies[tenant] = name
+	}
+	fmt.Printf("Loaded routing strategies for %d tenants\n", len(tenantStrategies))
+	return nil
+}
+
+// Pick the strategy for a request: ?strategy=, then the tenant's (?tenant= or X-Tenant), then ROUTING_STRATEGY
+func strategyForRequest(r *http.Request) (RoutingStrategy, error) {
+	name := r.URL.Query().Get("strategy")
+	if name == "" {
+		name = tenantStrategies[requestTenant(r)]
+	}
+	if name == "" {
+		name = defaultStrategyName
+	}
+	strategy, ok := routingStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown routing strategy %q", name)
+	}
+	return strategy, nil
+}
+
+// Instance of a strategy with state of its own, so a simulation does not advance the live round-robin rotation
+func freshStrategy(strategy RoutingStrategy) RoutingStrategy {
+	if _, ok := strategy.(*roundRobinStrategy); ok {
+		return &roundRobinStrategy{}
+	}
+	return strategy
+}
+
+// Tenant a request belongs to (?tenant= or X-Tenant)
+func requestTenant(r *http.Request) string {
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		return tenant
+	}
+	return r.Header.Get("X-Tenant")
+}
+
+// Rank nodes for a client with a strategy and distance model
+func rankWith(strategy RoutingStrategy, model string, clientLat, clientLon float64, filter nodeFilter, count int) []rankedNode {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	ranked := strategy.Rank(routingRequest{Lat: clientLat, Lon: clientLon, Filter: filter, Count: count, Now: time.Now(), Fleet: liveFleet(), Model: model})
+	if len(ranked) > count {
+		ranked = ranked[:count]
+	}
+	return ranked
+}
+
+// Rank up to count nodes for a client with the default strategy
+func rankNodes(clientLat, clientLon float64, filter nodeFilter, count int) []rankedNode {
+	return rankWith(routingStrategies[defaultStrategyName], defaultDistanceModel, clientLat, clientLon, filter, count)
+}
+
+// Check whether a node can take the request at all
+func routable(request routingRequest, id string) bool {
+	node, exists := request.Fleet.Nodes[id]
+	return exists && node.Status == "active" && !request.breakerOpen(id) && request.Filter.matches(node)
+}
+
+// Routable nodes within the routing radius, nearest first
+func nodesWithinRadius(request routingRequest) []rankedNode {
+	ids := request.nearest(max(routingRadiusNodes, request.Count), func(id string) bool {
+		return routable(request, id) && request.distance(request.Fleet.Nodes[id]) <= routingRadius
+	})
+	if len(ids) == 0 {
+		// Nothing close by: fall back to the nearest nodes anywhere
+		ids = request.nearest(max(routingCandidates, request.Count), func(id string) bool {
+			return routable(request, id)
+		})
+	}
+	return toRanked(request, ids)
+}
+
+// Candidates for ids with distance and saturation filled in, scored by their position
+func toRanked(request routingRequest, ids []string) []rankedNode {
+	ranked := make([]rankedNode, 0, len(ids))
+	for i, id := range ids {
+		node := request.Fleet.Nodes[id]
+		ranked = append(ranked, rankedNode{
+			Node:       node,
+			DistanceKm: request.distance(node),
+			Score:      float64(i),
+			Saturated:  isSaturated(node, request.Now),
+		})
+	}
+	return ranked
+}
+
+// Pure great-circle distance, ignoring load
+type haversineStrategy struct{}
+
+func (haversineStrategy) Name() string { return "haversine" }
+
+func (haversineStrategy) Rank(request routingRequest) []rankedNode {
+	ids := request.nearest(request.Count, func(id string) bool {
+		return routable(request, id)
+	})
+	ranked := toRanked(request, ids)
+	for i := range ranked {
+		ranked[i].Score = ranked[i].DistanceKm / routingDistanceScale
+	}
+	return ranked
+}
+
+// Least loaded node within the routing radius, distance only breaking ties
+type leastLoadStrategy struct{}
+
+func (leastLoadStrategy) Name() string { return "least-load" }
+
+func (leastLoadStrategy) Rank(request routingRequest) []rankedNode {
+	ranked := nodesWithinRadius(request)
+	for i := range ranked {
+		ranked[i].Score = routingScore(ranked[i].Node, 0, request.Now) + ranked[i].DistanceKm/routingRadius*1e-3
+		if ranked[i].Saturated {
+			ranked[i].Score += 1e6
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score < ranked[j].Score })
+	return ranked
+}
+
+// Nodes within the routing radius take turns
+type roundRobinStrategy struct {
+	next atomic.Uint64
+}
+
+func (*roundRobinStrategy) Name() string { return "round-robin" }
+
+func (strategy *roundRobinStrategy) Rank(request routingRequest) []rankedNode {
+	ranked := nodesWithinRadius(request)
+	if len(ranked) == 0 {
+		return ranked
+	}
+	// Sort by ID so the rotation does not depend on the client's exact position
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].Node.ID < ranked[j].Node.ID })
+	start := int(strategy.next.Add(1) % uint64(len(ranked)))
+	ranked = append(ranked[start:], ranked[:start]...)
+	for i := range ranked {
+		ranked[i].Score = float64(i)
+	}
+	return ranked
+}
+
+// Uniformly random node within the routing radius, as a baseline for experiments
+type randomStrategy struct{}
+
+func (randomStrategy) Name() string { return "random" }
+
+func (randomStrategy) Rank(request routingRequest) []rankedNode {
+	ranked := nodesWithinRadius(request)
+	mathrand.Shuffle(len(ranked), func(i, j int) { ranked[i], ranked[j] = ranked[j], ranked[i] })
+	for i := range ranked {
+		ranked[i].Score = float64(i)
+	}
+	return ranked
+}
+
+// Nearest node where it is currently daytime (FOLLOW_THE_SUN_HOURS local solar time), then the rest by distance
+type followTheSunStrategy struct{}
+
+func (followTheSunStrategy) Name() string { return "follow-the-sun" }
+
+func (followTheSunStrategy) Rank(request routingRequest) []rankedNode {
+	start, end := 8.0, 20.0
+	if from, to, ok := strings.Cut(followTheSunHours, "-"); ok {
+		if value, err := strconv.ParseFloat(from, 64); err == nil {
+			start = value
+		}
+		if value, err := strconv.ParseFloat(to, 64); err == nil {
+			end = value
+		}
+	}
+	daytime := func(node Node) bool {
+		utc := request.Now.UTC()
+		hour := math.Mod(float64(utc.Hour())+float64(utc.Minute())/60+node.Longitude/15+24, 24)
+		if start <= end {
+			return hour >= start && hour < end
+		}
+		return hour >= start || hour < end // Window across midnight, e.g. "22-6"
+	}
+
+	day := request.nearest(request.Count, func(id string) bool {
+		return routable(request, id) && daytime(request.Fleet.Nodes[id])
+	})
+	night := request.nearest(request.Count, func(id string) bool {
+		return routable(request, id) && !daytime(request.Fleet.Nodes[id])
+	})
+	ranked := toRanked(request, append(day, night...))
+	for i := range ranked {
+		ranked[i].Score = ranked[i].DistanceKm / routingDistanceScale
+		if i >= len(day) {
+			ranked[i].Score += 1e3 // Night-time nodes only after every daytime one
+		}
+	}
+	return ranked
+}
+
+// Blend of distance (or measured latency) and load among the nearest candidates, plus nodes measured
+// from the client's area. Saturated nodes only follow once every free candidate is listed.
+type weightedStrategy struct{}
+
+func (weightedStrategy) Name() string { return "weighted" }
+
+func (weightedStrategy) Rank(request routingRequest) []rankedNode {
+	clientLat, clientLon, filter, count, now := request.Lat, request.Lon, request.Filter, request.Count, request.Now
+	measured := make(map[string]float64)
+	if !request.Fleet.Simulated {
+		measured = measuredLatencies(clientLat, clientLon, now)
+	}
+	overheadKm := rttOverheadKm(request, measured)
+	seen := make(map[string]bool)
+	var ranked []rankedNode
+	for _, skipSaturated := range []bool{true, false} {
+		if len(ranked) >= count {
+			break
+		}
+		accept := func(id string) bool {
+			node, exists := request.Fleet.Nodes[id]
+			return exists && !seen[id] && node.Status == "active" && !request.breakerOpen(id) && filter.matches(node) &&
+				!(skipSaturated && isSaturated(node, now))
+		}
+		// The nearest nodes, plus any node clients in this area have measured
+		ids := request.nearest(max(routingCandidates, count), accept)
+		for id := range measured {
+			if accept(id) && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+
+		pass := make([]rankedNode, 0, len(ids))
+		for _, id := range ids {
+			node := request.Fleet.Nodes[id]
+			candidate := rankedNode{Node: node, DistanceKm: request.distance(node), Saturated: !skipSaturated && isSaturated(node, now)}
+			effectiveKm := candidate.DistanceKm + overheadKm
+			if rtt, ok := measured[id]; ok {
+				candidate.RTTMillis = &rtt
+				effectiveKm = rtt * rttKmPerMillisecond // Measured latency beats the distance guess
+			}
+			candidate.Score = routingScore(node, effectiveKm, now)
+			pass = append(pass, candidate)
+			seen[id] = true
+		}
+		sort.SliceStable(pass, func(i, j int) bool { return pass[i].Score < pass[j].Score })
+		ranked = append(ranked, pass...)
+	}
+	return ranked
+}
+
+// Typical RTT on top of the distance (as km at RTT_KM_PER_MS) among the nodes measured from the
+// client's area. Measured RTT includes queueing and handshakes, so adding this to the distance of
+// unmeasured nodes keeps them from always looking closer than measured ones.
+func rttOverheadKm(request routingRequest, measured map[string]float64) float64 {
+	var overheads []float64
+	for id, rtt := range measured {
+		if node, exists := request.Fleet.Nodes[id]; exists {
+			overheads = append(overheads, math.Max(0, rtt*rttKmPerMillisecond-request.distance(node)))
+		}
+	}
+	if len(overheads) == 0 {
+		return 0
+	}
+	sort.Float64s(overheads)
+	return overheads[len(overheads)/2]
+}
+
+// Find the best node for a client that satisfies the filter
+func findNearestNode(clientLat, clientLon float64, filter nodeFilter) Node {
+	ranked := rankNodes(clientLat, clientLon, filter, 1)
+	if len(ranked) == 0 {
+		return Node{}
+	}
+	return ranked[0].Node
+}
+
+// Latency feedback settings: clients report the RTT they observe and routing prefers measured latency over distance
+var (
+	rttCellDegrees      = envFloat("RTT_CELL_DEGREES", 5)               // Size of the areas latency is tracked for
+	rttAlpha            = envFloat("RTT_EWMA_ALPHA", 0.2)               // Weight of a new sample in the moving average
+	rttMinSamples       = envInt("RTT_MIN_SAMPLES", 3)                  // Distinct reporting addresses needed before an estimate is used
+	rttMaxAge           = envDuration("RTT_MAX_AGE", time.Hour)         // Estimates without newer samples are dropped
+	rttKmPerMillisecond = envFloat("RTT_KM_PER_MS", 100)                // Distance light in fibre covers per millisecond of round trip
+	rttOutlierFactor    = envFloat("RTT_OUTLIER_FACTOR", 3)             // Samples are capped to this factor above or below a usable estimate
+	rttReportsPerIP     = envInt("RTT_REPORTS_PER_IP", 30)              // Reports accepted per minute from one address
+	rttReportsPerCell   = envInt("RTT_REPORTS_PER_CELL", 600)           // Reports accepted per minute for one area
+	rttEstimates        = make(map[rttCell]map[string]*LatencyEstimate) // Estimates by area and node ID, guarded by rttMutex
+	rttMutex            = &sync.RWMutex{}
+	rttReportLimits     = &rateWindow{}
+)
+
+// Counts events per key in fixed one-minute windows, to cap what one source can do
+type rateWindow struct {
+	mutex  sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// Count an event for a key, reporting whether it stays within the limit for the current minute
+func (window *rateWindow) allow(key string, limit int, now time.Time) bool {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	if window.counts == nil || now.Sub(window.start) >= time.Minute {
+		window.start, window.counts = now, make(map[string]int)
+	}
+	if window.counts[key] >= limit {
+		return false
+	}
+	window.counts[key]++
+	return true
+}
+
+// Area of the globe latency is tracked for
+type rttCell struct{ Lat, Lon int }
+
+// Moving average of the RTT clients in one area see to one node
+type LatencyEstimate struct {
+	RTTMillis float64   `json:"rtt_ms"`
+	Samples   int       `json:"samples"`
+	Sources   int       `json:"sources"` // Distinct reporting addresses, counted up to RTT_MIN_SAMPLES
+	UpdatedAt time.Time `json:"updated_at"`
+
+	reporters []string // Addresses counted in Sources
+}
+
+// Area containing a location
+func rttCellOf(lat, lon float64) rttCell {
+	size := rttCellDegrees
+	if size <= 0 {
+		size = 5
+	}
+	return rttCell{int(math.Floor(lat / size)), int(math.Floor(lon / size))}
+}
+
+// Usable RTT estimates (in milliseconds) for clients at a location, by node ID
+func measuredLatencies(lat, lon float64, now time.Time) map[string]float64 {
+	rttMutex.RLock()
+	defer rttMutex.RUnlock()
+
+	measured := make(map[string]float64)
+	for id, estimate := range rttEstimates[rttCellOf(lat, lon)] {
+		if estimate.Sources >= rttMinSamples && now.Sub(estimate.UpdatedAt) <= rttMaxAge {
+			measured[id] = estimate.RTTMillis
+		}
+	}
+	return measured
+}
+
+// Fold a client's RTT sample into the estimate for its area. Once the estimate is in use, a
+// sample far off it only moves it as far as RTT_OUTLIER_FACTOR allows.
+func recordRTT(nodeID, source string, lat, lon, rttMillis float64, now time.Time) {
+	rttMutex.Lock()
+	defer rttMutex.Unlock()
+
+	cell := rttCellOf(lat, lon)
+	if rttEstimates[cell] == nil {
+		rttEstimates[cell] = make(map[string]*LatencyEstimate)
+	}
+	estimate, ok := rttEstimates[cell][nodeID]
+	if !ok || now.Sub(estimate.UpdatedAt) > rttMaxAge {
+		rttEstimates[cell][nodeID] = &LatencyEstimate{RTTMillis: rttMillis, Samples: 1, Sources: 1, UpdatedAt: now, reporters: []string{source}}
+		return
+	}
+	if estimate.Sources >= rttMinSamples && rttOutlierFactor > 1 {
+		rttMillis = math.Max(estimate.RTTMillis/rttOutlierFactor, math.Min(rttMillis, estimate.RTTMillis*rttOutlierFactor))
+	}
+	estimate.RTTMillis += rttAlpha * (rttMillis - estimate.RTTMillis)
+	estimate.Samples++
+	estimate.UpdatedAt = now
+	if estimate.Sources < rttMinSamples && !slices.Contains(estimate.reporters, source) {
+		estimate.reporters = append(estimate.reporters, source)
+		estimate.Sources++
+	}
+}
+
+// Drop estimates nobody has refreshed, and forget evicted nodes
+func pruneRTTEstimates(now time.Time) {
+	mutex.RLock()
+	known := make(map[string]bool, len(nodes))
+	for id := range nodes {
+		known[id] = true
+	}
+	mutex.RUnlock()
+
+	rttMutex.Lock()
+	defer rttMutex.Unlock()
+	for cell, estimates := range rttEstimates {
+		for id, estimate := range estimates {
+			if !known[id] || now.Sub(estimate.UpdatedAt) > rttMaxAge {
+				delete(estimates, id)
+			}
+		}
+		if len(estimates) == 0 {
+			delete(rttEstimates, cell)
+		}
+	}
+}
+
+// Periodically prune the latency estimates
+func monitorRTTEstimates() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		pruneRTTEstimates(time.Now())
+	}
+}
+
+// Report RTT Handler (clients report the round trip they observed to a node from their coarse location)
+func reportRTTHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var report struct {
+		NodeID    string  `json:"node_id"`
+		Latitude  float64 `json:"lat"`
+		Longitude float64 `json:"lon"`
+		RTTMillis float64 `json:"rtt_ms"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&report); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateCoordinates(report.Latitude, report.Longitude); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.RTTMillis <= 0 || report.RTTMillis > 60000 {
+		http.Error(w, "Invalid rtt_ms", http.StatusBadRequest)
+		return
+	}
+
+	mutex.RLock()
+	node, exists := nodes[report.NodeID]
+	mutex.RUnlock()
+	if !exists {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	// Nothing travels faster than light in fibre, so a shorter round trip is made up
+	if report.RTTMillis*rttKmPerMillisecond < calculateDistance(report.Latitude, report.Longitude, node.Latitude, node.Longitude) {
+		http.Error(w, "rtt_ms is shorter than the distance allows", http.StatusBadRequest)
+		return
+	}
+
+	source, now := "", time.Now()
+	if ip := requestIP(r); ip != nil {
+		source = ip.String()
+	}
+	cell := rttCellOf(report.Latitude, report.Longitude)
+	if !rttReportLimits.allow("ip "+source, rttReportsPerIP, now) || !rttReportLimits.allow(fmt.Sprintf("cell %d,%d", cell.Lat, cell.Lon), rttReportsPerCell, now) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many RTT reports", http.StatusTooManyRequests)
+		return
+	}
+
+	recordRTT(report.NodeID, source, report.Latitude, report.Longitude, report.RTTMillis, now)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "RTT recorded"})
+}
+
+// RTT Estimates Handler (latency estimates for the area around ?lat=&lon=)
+func rttEstimatesHandler(w http.ResponseWriter, r *http.Request) {
+	lat, latErr := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, lonErr := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if latErr != nil || lonErr != nil {
+		http.Error(w, "Missing or invalid lat/lon", http.StatusBadRequest)
+		return
+	}
+	if err := validateCoordinates(lat, lon); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rttMutex.RLock()
+	estimates := make(map[string]LatencyEstimate)
+	for id, estimate := range rttEstimates[rttCellOf(lat, lon)] {
+		estimates[id] = *estimate
+	}
+	rttMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"estimates": estimates})
+}
+
+// Fleet snapshot settings: redirect responses carry a signed list of nearby nodes that clients cache for fallback
+var (
+	fleetSnapshotSize = envInt("FLEET_SNAPSHOT_SIZE", 5)
+	fleetSnapshotTTL  = envDuration("FLEET_SNAPSHOT_TTL", 24*time.Hour)
+	fleetSigningKey   ed25519.PrivateKey
+)
+
+// Node entry in a fleet snapshot
+type fleetNode struct {
+	ID        string  `json:"id"`
+	IPAddress string  `json:"ip_address"`
+	Port      string  `json:"port"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Nearby nodes at a registry version, signed so clients can trust a cached copy later
+type fleetSnapshot struct {
+	Version   uint64      `json:"version"` // Registry sequence number the list was taken at
+	IssuedAt  time.Time   `json:"issued_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	Nodes     []fleetNode `json:"nodes"`
+}
+
+// Snapshot bytes with their ed25519 signature
+type signedFleet struct {
+	Snapshot  json.RawMessage `json:"snapshot"`
+	Signature string          `json:"signature"`
+}
+
+// Load the fleet signing key, creating it on first start
+func loadOrCreateFleetKey() error {
+	keyPath := filepath.Join(registryFolder, "fleet-key.pem")
+	if keyPEM, err := os.ReadFile(keyPath); err == nil {
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return fmt.Errorf("invalid PEM in %s", keyPath)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parsing fleet key: %v", err)
+		}
+		signingKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("fleet key is not an ed25519 key")
+		}
+		fleetSigningKey = signingKey
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(registryFolder, 0755); err != nil {
+		return err
+	}
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(signingKey)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	fleetSigningKey = signingKey
+	logToActiveLog("Fleet signing key created", keyPath)
+	return nil
+}
+
+// The nearest active nodes matching the filter, nearest first
+func nearestNodes(clientLat, clientLon float64, filter nodeFilter, count int) ([]Node, uint64) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	ids := nodeIndex.nearest(clientLat, clientLon, count, func(id string) bool {
+		node := nodes[id]
+		return node.Status == "active" && !breakerOpen(id, time.Now()) && filter.matches(node)
+	})
+	candidates := make([]Node, 0, len(ids))
+	for _, id := range ids {
+		candidates = append(candidates, nodes[id])
+	}
+	return candidates, registrySeq
+}
+
+// Build and sign the fleet snapshot for a client location
+func buildSignedFleet(clientLat, clientLon float64, filter nodeFilter) (signedFleet, error) {
+	if fleetSigningKey == nil {
+		return signedFleet{}, fmt.Errorf("no fleet signing key")
+	}
+
+	nearby, version := nearestNodes(clientLat, clientLon, filter, fleetSnapshotSize)
+	now := time.Now().UTC()
+	snapshot := fleetSnapshot{Version: version, IssuedAt: now, ExpiresAt: now.Add(fleetSnapshotTTL), Nodes: make([]fleetNode, 0, len(nearby))}
+	for _, node := range nearby {
+		snapshot.Nodes = append(snapshot.Nodes, fleetNode{
+			ID:        node.ID,
+			IPAddress: node.IPAddress,
+			Port:      node.Port,
+			Latitude:  node.Latitude,
+			Longitude: node.Longitude,
+		})
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return signedFleet{}, err
+	}
+	return signedFleet{Snapshot: data, Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(fleetSigningKey, data))}, nil
+}
+
+// Fleet Key Handler (public key clients use to verify fleet snapshots)
+func fleetKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if fleetSigningKey == nil {
+		http.Error(w, "Fleet snapshots are not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"algorithm":  "ed25519",
+		"public_key": base64.StdEncoding.EncodeToString(fleetSigningKey.Public().(ed25519.PublicKey)),
+	})
+}
+
+// Default distance model: "haversine" (sphere of radius 6371 km) or "vincenty" (WGS-84 ellipsoid,
+// accurate to about a millimetre but slower). Routing requests may pick the other one.
+var defaultDistanceModel = envString("DISTANCE_MODEL", "haversine")
+
+// Smallest ratio of the ellipsoidal to the spherical distance (about 0.9944, north-south at the equator)
+const ellipsoidMinRatio = 0.994
+
+// WGS-84 ellipsoid
+const (
+	wgs84A           = 6378.137 // Equatorial radius in km
+	wgs84F           = 1 / 298.257223563
+	wgs84B           = wgs84A * (1 - wgs84F)
+	rectifyingRadius = 6367.449146 // Sphere with the ellipsoid's meridian length, for the antipodal fallback
+)
+
+// Check that a location is on the globe: latitude within ±90 and longitude within ±180
+func validateCoordinates(lat, lon float64) error {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return fmt.Errorf("Invalid latitude value %v, must be between -90 and 90", lat)
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return fmt.Errorf("Invalid longitude value %v, must be between -180 and 180", lon)
+	}
+	return nil
+}
+
+// Distance calculation between two geo-coordinates, in km, with the default model
+func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	return distanceWith(defaultDistanceModel, lat1, lon1, lat2, lon2)
+}
+
+// Distance between two geo-coordinates, in km, with the given model
+func distanceWith(model string, lat1, lon1, lat2, lon2 float64) float64 {
+	if model == "vincenty" {
+		return vincentyDistance(lat1, lon1, lat2, lon2)
+	}
+	return haversineDistance(lat1, lon1, lat2, lon2)
+}
+
+// Check a distance model name, with "" standing for the default
+func validDistanceModel(model string) (string, error) {
+	switch model {
+	case "":
+		return defaultDistanceModel, nil
+	case "haversine", "vincenty":
+		return model, nil
+	}
+	return "", fmt.Errorf("unknown distance model %q, must be haversine or vincenty", model)
+}
+
+// Central angle between two points in radians
+func centralAngle(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+
+	lat1 = lat1 * math.Pi / 180
+	lat2 = lat2 * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * math.Atan2(math.Sqrt(a), math.Sqrt(math.Max(0, 1-a)))
+}
+
+// Great-circle distance on a sphere with Earth's mean radius
+func haversineDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	const R = 6371 // Earth's radius in km
+	return R * centralAngle(lat1, lon1, lat2, lon2)
+}
+
+// Geodesic distance on the WGS-84 ellipsoid (Vincenty's inverse formula). For nearly antipodal points,
+// where the iteration does not converge, the sphere with the ellipsoid's meridian length is used instead.
+func vincentyDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	// The distance only depends on the size of the longitude difference, however the longitudes wrap
+	L := math.Abs(math.Remainder((lon2-lon1)*math.Pi/180, 2*math.Pi))
+	U1 := math.Atan((1 - wgs84F) * math.Tan(lat1*math.Pi/180))
+	U2 := math.Atan((1 - wgs84F) * math.Tan(lat2*math.Pi/180))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	for i := 0; i < 200; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		if sinSigma == 0 {
+			if cosSigma > 0 {
+				return 0 // Same point
+			}
+			break // Exactly antipodal
+		}
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0 // Geodesic along the equator
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+		previous := lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda) > math.Pi {
+			break // Diverging: nearly antipodal
+		}
+		if math.Abs(lambda-previous) < 1e-12 {
+			uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+			A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return wgs84B * A * (sigma - deltaSigma)
+		}
+	}
+	return rectifyingRadius * centralAngle(lat1, lon1, lat2, lon2)
+}
+
+// Collect system metrics and log data
+func collectSystemMetrics() (map[string]interface{}, error) {
+	memoryStats, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	cpuUsage, err := cpu.Percent(time.Second, false)
+	if err != nil {
+		return nil, err
+	}
+
+	loadStats, err := load.Avg()
+	if err != nil {
+		return nil, err
+	}
+
+	powerConsumption := cpuUsage[0] // Assume power consumption correlates with CPU usage (in a very simplified manner)
+
+	metrics := map[string]interface{}{
+		"Memory Used %":                memoryStats.UsedPercent,
+		"CPU Usage %":                  cpuUsage[0],
+		"Load Average":                 loadStats.Load1,
+		"Power Consumption (estimate)": powerConsumption, // in percentage
+	}
+
+	// Log to passive log
+	logToPassiveLog("System Metrics Collected", metrics)
+
+	return metrics, nil
+}
+
+// Save metrics to the active log
+func logToActiveLog(action string, details interface{}) {
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	file, err := os.OpenFile("active_log_MainServer.csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening active log file: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	logEntry := fmt.Sprintf("[%s] ACTION: %s, DETAILS: %+v\n", timestamp, action, details)
+	if _, err := file.WriteString(logEntry); err != nil {
+		log.Printf("Error writing to active log file: %v\n", err)
+	}
+}
+
+// Save metrics to the passive log
+func logToPassiveLog(action string, details interface{}) {
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	file, err := os.OpenFile("passive_log_MainServer.csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening passive log file: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	logEntry := fmt.Sprintf("[%s] ACTION: %s, DETAILS: %+v\n", timestamp, action, details)
+	if _, err := file.WriteString(logEntry); err != nil {
+		log.Printf("Error writing to passive log file: %v\n", err)
+	}
+}
+
+// Session affinity settings: returning clients stay on the node they used before
+var (
+	affinityTTL         = envDuration("AFFINITY_TTL", time.Hour)    // How long an unused pin is kept
+	affinityMaxDistance = envFloat("AFFINITY_MAX_DISTANCE_KM", 500) // Pins further than this from the client are dropped
+	affinityScoreSlack  = envFloat("AFFINITY_SCORE_SLACK", 0.1)     // New clients are spread over candidates scoring within this of the best
+	affinityLoadFactor  = envFloat("AFFINITY_LOAD_FACTOR", 0.25)    // Nodes may hold this much more than their fair share of pinned clients
+	maxAffinityPins     = envInt("MAX_AFFINITY_PINS", 100000)       // Pins kept at once; new clients go unpinned past this
+	affinities          = make(map[string]affinityPin)              // Pins by client ID, guarded by affinityMutex
+	pinnedClients       = make(map[string]int)                      // Pinned clients per node ID, guarded by affinityMutex
+	affinityMutex       = &sync.Mutex{}
+)
+
+const affinityCookie = "nodepulse_client"
+
+// Node a client is pinned to
+type affinityPin struct {
+	NodeID   string
+	LastSeen time.Time
+}
+
+// The ID the client sent with ?client_id= or the affinity cookie, or "" if it sent none
+func clientIdentifier(r *http.Request) string {
+	if clientID := strings.TrimSpace(r.URL.Query().Get("client_id")); clientID != "" {
+		if len(clientID) > 128 {
+			return ""
+		}
+		return clientID
+	}
+	if cookie, err := r.Cookie(affinityCookie); err == nil && cookie.Value != "" && len(cookie.Value) <= 128 {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Give a browser without an ID a new affinity cookie, returning the ID ("" for other callers).
+// The new ID is only pinned once the browser sends it back.
+func issueClientCookie(w http.ResponseWriter, r *http.Request) string {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") && !strings.HasPrefix(r.UserAgent(), "Mozilla/") {
+		return ""
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	clientID := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{Name: affinityCookie, Value: clientID, Path: "/", MaxAge: int(affinityTTL.Seconds()), HttpOnly: true})
+	return clientID
+}
+
+// Pin a client to a node (caller holds affinityMutex)
+func pinClient(clientID, nodeID string, now time.Time) {
+	if previous, ok := affinities[clientID]; ok {
+		pinnedClients[previous.NodeID]--
+		if pinnedClients[previous.NodeID] <= 0 {
+			delete(pinnedClients, previous.NodeID)
+		}
+	} else if len(affinities) >= maxAffinityPins {
+		return
+	}
+	affinities[clientID] = affinityPin{NodeID: nodeID, LastSeen: now}
+	pinnedClients[nodeID]++
+}
+
+// Pin a client to the node it was just assigned to
+func pinAssignedClient(clientID, nodeID string) {
+	affinityMutex.Lock()
+	pinClient(clientID, nodeID, time.Now())
+	affinityMutex.Unlock()
+}
+
+// Put the client's node first: its pinned node while that stays healthy and close enough,
+// otherwise one of the best candidates picked by bounded-load consistent hashing.
+// Nothing is pinned here; the caller pins whichever node the client is actually assigned to.
+func applyAffinity(clientID string, model string, clientLat, clientLon float64, filter nodeFilter, ranked []rankedNode) ([]rankedNode, string) {
+	now := time.Now()
+	affinityMutex.Lock()
+	defer affinityMutex.Unlock()
+
+	if pin, ok := affinities[clientID]; ok {
+		mutex.RLock()
+		node, exists := nodes[pin.NodeID]
+		healthy := exists && node.Status == "active" && !breakerOpen(node.ID, now) && filter.matches(node) && !isSaturated(node, now)
+		mutex.RUnlock()
+
+		distance := distanceWith(model, clientLat, clientLon, node.Latitude, node.Longitude)
+		if healthy && distance <= affinityMaxDistance {
+			pinned := rankedNode{Node: node, DistanceKm: distance, Score: routingScore(node, distance, now)}
+			for _, candidate := range ranked {
+				if candidate.Node.ID == node.ID {
+					pinned = candidate
+				}
+			}
+			return moveToFront(ranked, pinned), "pinned"
+		}
+	}
+
+	// Candidates close enough to the best score to be interchangeable
+	var eligible []rankedNode
+	for _, candidate := range ranked {
+		if !candidate.Saturated && candidate.Score <= ranked[0].Score+affinityScoreSlack {
+			eligible = append(eligible, candidate)
+		}
+	}
+	if len(eligible) == 0 {
+		return ranked, "assigned"
+	}
+
+	// Rendezvous hashing keeps a client's choice stable as candidates come and go; the load
+	// bound skips nodes already holding more than their share of pinned clients
+	sort.Slice(eligible, func(i, j int) bool {
+		return affinityHash(clientID, eligible[i].Node.ID) > affinityHash(clientID, eligible[j].Node.ID)
+	})
+	total := 1
+	for _, candidate := range eligible {
+		total += pinnedClients[candidate.Node.ID]
+	}
+	bound := int(math.Ceil((1 + affinityLoadFactor) * float64(total) / float64(len(eligible))))
+	chosen := eligible[0]
+	for _, candidate := range eligible {
+		if pinnedClients[candidate.Node.ID] < bound {
+			chosen = candidate
+			break
+		}
+	}
+
+	return moveToFront(ranked, chosen), "assigned"
+}
+
+// Hash of a client and node pair
+func affinityHash(clientID, nodeID string) uint64 {
+	sum := sha256.Sum256([]byte(clientID + "|" + nodeID))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Put a candidate first, keeping the order of the rest
+func moveToFront(ranked []rankedNode, first rankedNode) []rankedNode {
+	reordered := []rankedNode{first}
+	for _, candidate := range ranked {
+		if candidate.Node.ID != first.Node.ID {
+			reordered = append(reordered, candidate)
+		}
+	}
+	return reordered
+}
+
+// Periodically forget pins of clients that have not come back
+func monitorAffinities() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		affinityMutex.Lock()
+		for clientID, pin := range affinities {
+			if now.Sub(pin.LastSeen) > affinityTTL {
+				pinnedClients[pin.NodeID]--
+				if pinnedClients[pin.NodeID] <= 0 {
+					delete(pinnedClients, pin.NodeID)
+				}
+				delete(affinities, clientID)
+			}
+		}
+		affinityMutex.Unlock()
+	}
+}
+
+// Admission control: clients recently sent to each node count against the node's declared capacity
+var (
+	assignmentTTL     = envDuration("ASSIGNMENT_TTL", 5*time.Minute) // How long a redirected client counts as a node's session
+	clientIDsPerIP    = envInt("CLIENT_IDS_PER_IP", 20)              // Sessions one address may hold under client IDs of its choosing
+	maxAssignments    = envInt("MAX_CLIENT_SESSIONS", 100000)        // Sessions tracked at once across all nodes
+	clientAssignments = make(map[string]clientAssignment)            // Node each client was last sent to, guarded by clientMutex
+	sourceSessions    = make(map[string]int)                         // Sessions held per client address, guarded by clientMutex
+)
+
+// Node a client was sent to and until when the session counts
+type clientAssignment struct {
+	NodeID  string
+	Source  string // Address the session was opened from
+	Expires time.Time
+}
+
+// Key identifying a client for admission control, and the address it came from. The key is the
+// client ID, or the address when the client sent none or when its address already holds
+// CLIENT_IDS_PER_IP sessions under other IDs, so rotating IDs gets no more places than that.
+func admissionKey(clientID string, r *http.Request) (string, string) {
+	source := r.RemoteAddr
+	if ip := requestIP(r); ip != nil {
+		source = ip.String()
+	}
+	if clientID == "" {
+		return source, source
+	}
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	if _, held := clientAssignments[clientID]; !held && sourceSessions[source] >= clientIDsPerIP {
+		return source, source
+	}
+	return clientID, source
+}
+
+// Send a client to a node if the node still has room, moving it off any node it held before.
+// The check and the assignment happen under one lock, so concurrent redirects cannot overfill a
+// node. A new session is refused while MAX_CLIENT_SESSIONS are open.
+func tryAssign(client, source string, node Node) bool {
+	now := time.Now()
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	if !roomFor(node, client, now) {
+		return false
+	}
+	previous, exists := clientAssignments[client]
+	if exists {
+		if previous.NodeID != node.ID {
+			releaseAssignment(previous.NodeID)
+			clientCount[node.ID]++
+		}
+		clientAssignments[client] = clientAssignment{NodeID: node.ID, Source: previous.Source, Expires: now.Add(assignmentTTL)}
+		return true
+	}
+	if len(clientAssignments) >= maxAssignments {
+		expireAssignments(now)
+		if len(clientAssignments) >= maxAssignments {
+			return false
+		}
+	}
+	clientAssignments[client] = clientAssignment{NodeID: node.ID, Source: source, Expires: now.Add(assignmentTTL)}
+	clientCount[node.ID]++
+	sourceSessions[source]++
+	return true
+}
+
+// Undo a client's assignment to a node that did not end up serving it
+func unassignClient(client, nodeID string) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	if assignment, exists := clientAssignments[client]; exists && assignment.NodeID == nodeID {
+		endAssignment(client, assignment)
+	}
+}
+
+// Drop one client from a node's count (caller holds clientMutex)
+func releaseAssignment(nodeID string) {
+	clientCount[nodeID]--
+	if clientCount[nodeID] <= 0 {
+		delete(clientCount, nodeID)
+	}
+}
+
+// Forget a client's session (caller holds clientMutex)
+func endAssignment(client string, assignment clientAssignment) {
+	releaseAssignment(assignment.NodeID)
+	delete(clientAssignments, client)
+	sourceSessions[assignment.Source]--
+	if sourceSessions[assignment.Source] <= 0 {
+		delete(sourceSessions, assignment.Source)
+	}
+}
+
+// End the sessions of clients that have not been redirected again (caller holds clientMutex)
+func expireAssignments(now time.Time) {
+	for client, assignment := range clientAssignments {
+		if now.After(assignment.Expires) {
+			endAssignment(client, assignment)
+		}
+	}
+}
+
+// End every assignment to a node that left the registry
+func releaseNodeAssignments(nodeID string) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	for client, assignment := range clientAssignments {
+		if assignment.NodeID == nodeID {
+			endAssignment(client, assignment)
+		}
+	}
+	delete(clientCount, nodeID)
+}
+
+// Check whether a node can take the client: a node with a declared capacity is full once its
+// assigned or reported clients reach it, but a client it already serves always fits
+func hasRoom(node Node, client string, now time.Time) bool {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	return roomFor(node, client, now)
+}
+
+// Check whether a node can take the client (caller holds clientMutex)
+func roomFor(node Node, client string, now time.Time) bool {
+	if node.Capacity <= 0 {
+		return true
+	}
+	assignment, assigned := clientAssignments[client]
+	used := clientCount[node.ID]
+	if assigned && assignment.NodeID == node.ID && now.Before(assignment.Expires) {
+		return true
+	}
+	if load, ok := currentLoad(node, now); ok && load.ActiveClients > used {
+		used = load.ActiveClients
+	}
+	return used < node.Capacity
+}
+
+// Periodically end assignments of clients that have not been redirected again
+func monitorAssignments() {
+	ticker := time.NewTicker(assignmentTTL / 10)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		clientMutex.Lock()
+		expireAssignments(now)
+		clientMutex.Unlock()
+	}
+}
+
+// Answer a request no node was found for: full nodes (503), data-residency rules (451) or nothing matching
+func noNodeError(w http.ResponseWriter, strategy RoutingStrategy, model string, lat, lon float64, filter nodeFilter, status int) {
+	if filter.Client != "" {
+		unlimited := filter
+		unlimited.Client = ""
+		if len(rankWith(strategy, model, lat, lon, unlimited, 1)) > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(assignmentTTL.Seconds()/10)))
+			http.Error(w, "All matching nodes are at capacity", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if filter.Fence != nil {
+		geofenceError(w, filter.Fence)
+		return
+	}
+	http.Error(w, "No active nodes found matching the request", status)
+}
+
+// Most candidates a single redirect may ask for
+const maxRedirectCandidates = 20
+
+// Redirect Client Handler (find nearest node and notify)
+func redirectClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientLat := r.URL.Query().Get("lat")
+	clientLon := r.URL.Query().Get("lon")
+
+	if clientLat == "" || clientLon == "" {
+		http.Error(w, "Missing client location parameters", http.StatusBadRequest)
+		return
+	}
+
+	var lat, lon float64
+	_, err := fmt.Sscanf(clientLat, "%f", &lat)
+	if err != nil {
+		http.Error(w, "Invalid latitude value", http.StatusBadRequest)
+		return
+	}
+	_, err = fmt.Sscanf(clientLon, "%f", &lon)
+	if err != nil {
+		http.Error(w, "Invalid longitude value", http.StatusBadRequest)
+		return
+	}
+	if err := validateCoordinates(lat, lon); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// How many ranked candidates to return (?k=3); without it only the best node is returned
+	count := 1
+	if value := r.URL.Query().Get("k"); value != "" {
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 1 || count > maxRedirectCandidates {
+			http.Error(w, fmt.Sprintf("Invalid k value, must be between 1 and %d", maxRedirectCandidates), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Pick the routing strategy (?strategy=, or the tenant's) and distance model (?distance_model=)
+	strategy, err := strategyForRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	model, err := validDistanceModel(r.URL.Query().Get("distance_model"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Find the best nodes offering what the client asked for (?capability=upload&tag=...&region=...)
+	// and allowed by the data-residency rules for the client
+	// and with room for another client
+	clientID := clientIdentifier(r)
+	filter := parseNodeFilter(r.URL.Query())
+	filter.Fence = geofenceFor(requestTenant(r), lat, lon)
+	filter.Client, filter.Source = admissionKey(clientID, r)
+	ranked := rankWith(strategy, model, lat, lon, filter, max(count, routingCandidates))
+	if len(ranked) == 0 {
+		noNodeError(w, strategy, model, lat, lon, filter, http.StatusInternalServerError)
+		return
+	}
+
+	// Keep returning clients on the node they used before (?client_id= or the affinity cookie)
+	// (browsers without an ID get one to send next time)
+	affinity, newClientID := "", ""
+	if clientID != "" {
+		ranked, affinity = applyAffinity(clientID, model, lat, lon, filter, ranked)
+	} else {
+		newClientID = issueClientCookie(w, r)
+	}
+	// Send the client to the first candidate that still has room once the assignment is
+	// recorded; another redirect may have taken the last place since the candidates were ranked
+	assigned := -1
+	// (a node on trial after its breaker opened takes only a few requests at a time)
+	for i, candidate := range ranked {
+		if !claimBreakerTrial(candidate.Node.ID, time.Now()) {
+			continue
+		}
+		if tryAssign(filter.Client, filter.Source, candidate.Node) {
+			assigned = i
+			break
+		}
+		releaseBreakerTrial(candidate.Node.ID)
+	}
+	if assigned < 0 {
+		noNodeError(w, strategy, model, lat, lon, filter, http.StatusServiceUnavailable)
+		return
+	}
+	// Pin the node the client got, unless admission control counted it by address instead
+	if clientID != "" && filter.Client == clientID {
+		pinAssignedClient(clientID, ranked[assigned].Node.ID)
+	}
+	if assigned > 0 {
+		affinity = "assigned" // The pinned node filled up in the meantime
+	}
+	ranked = moveToFront(ranked, ranked[assigned])
+	if len(ranked) > count {
+		ranked = ranked[:count]
+	}
+	nearestNode := ranked[0].Node
+	// Collect system metrics
+	metrics, err := collectSystemMetrics()
+	if err != nil {
+		log.Printf("Error collecting system metrics: %v\n", err)
+	} else {
+		// Save metrics to passive log
+		logToPassiveLog("System Metrics Collected", metrics)
+	}
+
+	// Respond with the nearest node information
+	response := map[string]interface{}{
+		"nearest_node_id":   nearestNode.ID,
+		"nearest_node_ip":   nearestNode.IPAddress,
+		"nearest_node_port": nearestNode.Port,
+		"nearest_node_lat":  fmt.Sprintf("%f", nearestNode.Latitude),
+		"nearest_node_lon":  fmt.Sprintf("%f", nearestNode.Longitude),
+	}
+	response["strategy"] = strategy.Name()
+	response["distance_model"] = model
+	if clientID != "" {
+		response["client_id"] = clientID
+		response["affinity"] = affinity
+	} else if newClientID != "" {
+		response["client_id"] = newClientID
+	}
+	if r.URL.Query().Has("k") {
+		candidates := make([]map[string]interface{}, 0, len(ranked))
+		for _, candidate := range ranked {
+			entry := map[string]interface{}{
+				"id":          candidate.Node.ID,
+				"ip_address":  candidate.Node.IPAddress,
+				"port":        candidate.Node.Port,
+				"latitude":    candidate.Node.Latitude,
+				"longitude":   candidate.Node.Longitude,
+				"status":      candidate.Node.Status,
+				"distance_km": candidate.DistanceKm,
+				"score":       candidate.Score,
+				"saturated":   candidate.Saturated,
+			}
+			if candidate.RTTMillis != nil {
+				entry["rtt_ms"] = *candidate.RTTMillis
+			}
+			candidates = append(candidates, entry)
+		}
+		response["candidates"] = candidates
+	}
+	// Nearby nodes the client can fall back to if this node or the main server goes away
+	if fleet, err := buildSignedFleet(lat, lon, filter); err != nil {
+		log.Printf("Error building fleet snapshot: %v\n", err)
+	} else {
+		response["fleet"] = fleet
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+
+	// Notify the nearest node asynchronously
+	go func() {
+		sendMessageToNode(nearestNode, "Client redirected to your server")
+	}()
+}
+
+// Send a message to a specific server node
+func sendMessageToNode(node Node, message string) {
+	// Prepare the message payload
+	msg := map[string]string{
+		"node_id": node.ID,
+		"message": message,
+	}
+
+	// Marshal the message into JSON
+	data, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Println("Error marshalling message:", err)
+		return
+	}
+
+	// Construct the node's URL
+	url := nodeBaseURL(node) + "/receive"
+	fmt.Printf("Sending message to node: %s\n", url)
+
+	// Send the message to the server node
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		fmt.Println("Error sending message to node:", err)
+		recordOutcome(node.ID, "notify", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Log the response from the server node
+	respBody, _ := io.ReadAll(resp.Body)
+	fmt.Printf("Response from node: %s\n", respBody)
+	// The endpoint exists on every node, so a 4xx is as much a failure as a 5xx; 503 only means the node is full
+	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode != http.StatusServiceUnavailable {
+		recordOutcome(node.ID, "notify", fmt.Errorf("unexpected status code %d", resp.StatusCode))
+		return
+	}
+	recordOutcome(node.ID, "notify", nil)
+}
+
+// Long Polling Handler
+func longPollHandler(w http.ResponseWriter, r *http.Request) {
+	// Simulate a long polling response
+	time.Sleep(10 * time.Second) // Simulate a delay
+
+	response := map[string]string{
+		"status":  "ok",
+		"message": "Long polling response",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Data-residency rule: clients in an area (or of a tenant) may only be sent to nodes inside the given areas
+type geofenceRule struct {
+	Name    string   `json:"name"`
+	Tenant  string   `json:"tenant,omitempty"`  // Only this tenant's requests; empty for every request
+	Clients string   `json:"clients,omitempty"` // Area the client must be in for the rule to apply; empty for anywhere
+	Nodes   []string `json:"nodes"`             // Areas a node must be in to serve the client
+}
+
+// Area in GEOFENCE_FILE: country codes, a GeoJSON geometry/feature/feature collection, or both
+type geofenceArea struct {
+	Countries []string        `json:"countries,omitempty"`
+	GeoJSON   json.RawMessage `json:"geojson,omitempty"`
+}
+
+// Layout of GEOFENCE_FILE
+type geofenceConfig struct {
+	Areas map[string]geofenceArea `json:"areas"`
+	Rules []geofenceRule          `json:"rules"`
+}
+
+// Polygon in lon/lat with its bounding box; the first ring is the outline, the others are holes
+type geoPolygon struct {
+	Rings  [][][2]float64
+	MinLat float64
+	MaxLat float64
+	MinLon float64
+	MaxLon float64
+}
+
+// Area made of one or more polygons
+type geoArea []geoPolygon
+
+// Geofence settings, loaded once at startup
+var (
+	geofenceAreas = make(map[string]geoArea)
+	geofenceRules []geofenceRule
+)
+
+// Country code properties tried on the features of the country boundaries file
+var countryCodeProperties = []string{"ISO_A2_EH", "ISO_A2", "iso_a2", "ISO3166-1-Alpha-2", "country_code", "country"}
+
+// Build a polygon from GeoJSON rings
+func newGeoPolygon(rings [][][2]float64) geoPolygon {
+	polygon := geoPolygon{Rings: rings, MinLat: 90, MaxLat: -90, MinLon: 180, MaxLon: -180}
+	for _, ring := range rings {
+		for _, point := range ring {
+			polygon.MinLon, polygon.MaxLon = math.Min(polygon.MinLon, point[0]), math.Max(polygon.MaxLon, point[0])
+			polygon.MinLat, polygon.MaxLat = math.Min(polygon.MinLat, point[1]), math.Max(polygon.MaxLat, point[1])
+		}
+	}
+	return polygon
+}
+
+// Check whether a point is inside the polygon (even-odd rule, so holes are excluded)
+func (polygon geoPolygon) contains(lat, lon float64) bool {
+	if lat < polygon.MinLat || lat > polygon.MaxLat || lon < polygon.MinLon || lon > polygon.MaxLon {
+		return false
+	}
+	inside := false
+	for _, ring := range polygon.Rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > lat) != (b[1] > lat) && lon < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// Check whether a point is inside any of the area's polygons
+func (area geoArea) contains(lat, lon float64) bool {
+	for _, polygon := range area {
+		if polygon.contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the polygons of a GeoJSON geometry, feature or collection
+func parseGeoJSON(data json.RawMessage) (geoArea, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil // Features without a geometry
+	}
+	var object struct {
+		Type        string            `json:"type"`
+		Coordinates json.RawMessage   `json:"coordinates"`
+		Geometry    json.RawMessage   `json:"geometry"`
+		Geometries  []json.RawMessage `json:"geometries"`
+		Features    []json.RawMessage `json:"features"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	switch object.Type {
+	case "Polygon":
+		var rings [][][2]float64
+		if err := json.Unmarshal(object.Coordinates, &rings); err != nil {
+			return nil, err
+		}
+		return geoArea{newGeoPolygon(rings)}, nil
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		if err := json.Unmarshal(object.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+		var area geoArea
+		for _, rings := range polygons {
+			area = append(area, newGeoPolygon(rings))
+		}
+		return area, nil
+	case "Feature":
+		return parseGeoJSON(object.Geometry)
+	case "FeatureCollection", "GeometryCollection":
+		var area geoArea
+		for _, member := range append(object.Features, object.Geometries...) {
+			polygons, err := parseGeoJSON(member)
+			if err != nil {
+				return nil, err
+			}
+			area = append(area, polygons...)
+		}
+		return area, nil
+	}
+	return nil, fmt.Errorf("unsupported GeoJSON type %q", object.Type)
+}
+
+// Load country outlines by ISO code from a GeoJSON feature collection (e.g. Natural Earth admin-0 countries)
+func loadCountryBoundaries() (map[string]geoArea, error) {
+	path := envString("COUNTRY_BOUNDARIES_FILE", filepath.Join(registryFolder, "countries.geojson"))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var collection struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   json.RawMessage        `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	countries := make(map[string]geoArea)
+	for _, feature := range collection.Features {
+		code := ""
+		for _, property := range countryCodeProperties {
+			if value, ok := feature.Properties[property].(string); ok && len(value) == 2 {
+				code = strings.ToUpper(value)
+				break
+			}
+		}
+		if code == "" {
+			continue
+		}
+		area, err := parseGeoJSON(feature.Geometry)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s outline in %s: %v", code, path, err)
+		}
+		countries[code] = append(countries[code], area...)
+	}
+	return countries, nil
+}
+
+// Load the data-residency rules, if there are any
+func loadGeofence() error {
+	path := envString("GEOFENCE_FILE", filepath.Join(registryFolder, "geofence.json"))
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var config geofenceConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	var countries map[string]geoArea // Only read when an area names countries
+	for name, definition := range config.Areas {
+		var area geoArea
+		if len(definition.Countries) > 0 && countries == nil {
+			if countries, err = loadCountryBoundaries(); err != nil {
+				return fmt.Errorf("loading country boundaries for area %q: %v", name, err)
+			}
+		}
+		for _, code := range definition.Countries {
+			outline, ok := countries[strings.ToUpper(code)]
+			if !ok {
+				return fmt.Errorf("area %q: no boundary for country %q", name, code)
+			}
+			area = append(area, outline...)
+		}
+		polygons, err := parseGeoJSON(definition.GeoJSON)
+		if err != nil {
+			return fmt.Errorf("area %q: %v", name, err)
+		}
+		area = append(area, polygons...)
+		if len(area) == 0 {
+			return fmt.Errorf("area %q has no countries or polygons", name)
+		}
+		geofenceAreas[name] = area
+	}
+
+	for _, rule := range config.Rules {
+		if len(rule.Nodes) == 0 {
+			return fmt.Errorf("rule %q lists no node areas", rule.Name)
+		}
+		for _, name := range append([]string{rule.Clients}, rule.Nodes...) {
+			if _, ok := geofenceAreas[name]; name != "" && !ok {
+				return fmt.Errorf("rule %q uses unknown area %q", rule.Name, name)
+			}
+		}
+	}
+	geofenceRules = config.Rules
+	fmt.Printf("Loaded %d geofence rules over %d areas\n", len(geofenceRules), len(geofenceAreas))
+	return nil
+}
+
+// Rules applying to one client; a node must satisfy all of them
+type geofence struct {
+	Rules []geofenceRule
+}
+
+// The rules applying to a client of a tenant at a location, or nil if none do
+func geofenceFor(tenant string, lat, lon float64) *geofence {
+	var applying []geofenceRule
+	for _, rule := range geofenceRules {
+		if rule.Tenant != "" && rule.Tenant != tenant {
+			continue
+		}
+		if rule.Clients != "" && !geofenceAreas[rule.Clients].contains(lat, lon) {
+			continue
+		}
+		applying = append(applying, rule)
+	}
+	if len(applying) == 0 {
+		return nil
+	}
+	return &geofence{Rules: applying}
+}
+
+// Check whether a node is inside one of the allowed areas of every rule
+func (fence *geofence) allows(node Node) bool {
+	for _, rule := range fence.Rules {
+		inside := false
+		for _, name := range rule.Nodes {
+			if geofenceAreas[name].contains(node.Latitude, node.Longitude) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return false
+		}
+	}
+	return true
+}
+
+// Tell the client that no node may legally serve it, naming the rules involved
+func geofenceError(w http.ResponseWriter, fence *geofence) {
+	names := make([]string, 0, len(fence.Rules))
+	for _, rule := range fence.Rules {
+		names = append(names, rule.Name)
+	}
+	http.Error(w, fmt.Sprintf("No active node satisfies the data-residency rules for this client (%s)", strings.Join(names, ", ")),
+		http.StatusUnavailableForLegalReasons)
+}
+
+// Proxy settings: the main server can forward client traffic to the selected node itself
+var (
+	proxyMode            = os.Getenv("PROXY_MODE") == "true"                     // Also proxy /receive and /upload, not only /proxy/...
+	proxyAttempts        = envInt("PROXY_MAX_ATTEMPTS", 3)                       // Candidates tried when a node cannot be reached
+	proxyConnectTimeout  = envDuration("PROXY_CONNECT_TIMEOUT", 5*time.Second)   // Time allowed to connect to a node
+	proxyResponseTimeout = envDuration("PROXY_RESPONSE_TIMEOUT", 60*time.Second) // Time allowed for a node to start answering
+	proxyTransport       = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: proxyConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   proxyConnectTimeout,
+		ResponseHeaderTimeout: proxyResponseTimeout,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+)
+
+// Request body that can be offered to another node as long as nothing has been read from it yet
+type replayableBody struct {
+	body io.ReadCloser
+	read bool
+}
+
+func (b *replayableBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.read = true
+	}
+	return n, err
+}
+
+// Close is left to the proxy handler, so a failed attempt does not close the body for the next one
+func (b *replayableBody) Close() error { return nil }
+
+// Error of a proxied request when every candidate filled up or failed before it was tried
+var errNoCandidateLeft = errors.New("no candidate node left with room")
+
+// Transport sending a request to the first candidate node that accepts the connection
+type failoverTransport struct {
+	candidates []Node
+	path       string // Path on the node
+	client     string // Admission key of the client, assigned to the node that answers
+	source     string // Address the client came from
+	pin        string // Client ID to pin to the node that answers, or "" to pin nothing
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body *replayableBody
+	if req.Body != nil {
+		body = &replayableBody{body: req.Body}
+	}
+
+	var lastErr error
+	for _, node := range t.candidates {
+		if !claimBreakerTrial(node.ID, time.Now()) {
+			continue // Failed repeatedly since it was ranked, or its trial permits are taken
+		}
+		if !tryAssign(t.client, t.source, node) {
+			releaseBreakerTrial(node.ID)
+			continue // Filled up since it was ranked
+		}
+		target, err := url.Parse(nodeBaseURL(node))
+		if err != nil {
+			unassignClient(t.client, node.ID)
+			releaseBreakerTrial(node.ID)
+			lastErr = err
+			continue
+		}
+		attempt := req.Clone(req.Context())
+		attempt.URL.Scheme, attempt.URL.Host = target.Scheme, target.Host
+		attempt.URL.Path = strings.TrimRight(target.Path, "/") + t.path
+		attempt.URL.RawPath = ""
+		attempt.Host = "" // Tunnels such as ngrok route on the Host header
+		if body != nil {
+			attempt.Body = body
+		}
+
+		resp, err := proxyTransport.RoundTrip(attempt)
+		switch {
+		case err != nil:
+			recordOutcome(node.ID, "proxy", err)
+		case resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusServiceUnavailable:
+			recordOutcome(node.ID, "proxy", fmt.Errorf("unexpected status code %d", resp.StatusCode))
+		default:
+			recordOutcome(node.ID, "proxy", nil) // 503 only means the node is full
+		}
+		if err != nil || resp.StatusCode == http.StatusServiceUnavailable {
+			unassignClient(t.client, node.ID)
+		} else if t.pin != "" {
+			pinAssignedClient(t.pin, node.ID)
+		}
+		if err == nil {
+			resp.Header.Set("X-Served-By-Node", node.ID)
+			return resp, nil
+		}
+		lastErr = err
+		logToActiveLog("Proxy attempt failed", map[string]string{"node_id": node.ID, "error": err.Error()})
+		if body != nil && body.read {
+			break // Part of the body is gone; another node would get a truncated request
+		}
+	}
+	if lastErr == nil {
+		lastErr = errNoCandidateLeft
+	}
+	return nil, lastErr
+}
+
+// Proxy Handler (forward the request to the best node for the client, streaming both ways)
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	// The node path: /proxy/upload -> /upload; in proxy mode /receive and /upload are forwarded as they are
+	path := r.URL.Path
+	prefix := ""
+	if strings.HasPrefix(path, "/proxy/") {
+		prefix = "/proxy"
+		path = strings.TrimPrefix(path, prefix)
+	}
+
+	lat, lon, err := clientLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	strategy, err := strategyForRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	model, err := validDistanceModel(r.URL.Query().Get("distance_model"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only nodes that offer what the path needs
+	query := r.URL.Query()
+	switch path {
+	case "/receive":
+		query.Add("capability", "receive")
+	case "/upload":
+		query.Add("capability", "upload")
+	}
+	clientID := clientIdentifier(r)
+	filter := parseNodeFilter(query)
+	filter.Fence = geofenceFor(requestTenant(r), lat, lon)
+	filter.Client, filter.Source = admissionKey(clientID, r)
+	ranked := rankWith(strategy, model, lat, lon, filter, max(proxyAttempts, routingCandidates))
+	if len(ranked) == 0 {
+		noNodeError(w, strategy, model, lat, lon, filter, http.StatusServiceUnavailable)
+		return
+	}
+	if clientID != "" {
+		ranked, _ = applyAffinity(clientID, model, lat, lon, filter, ranked)
+	} else {
+		issueClientCookie(w, r)
+	}
+	pin := ""
+	if clientID != "" && filter.Client == clientID {
+		pin = clientID // Admitted under its own ID rather than counted by address
+	}
+	candidates := make([]Node, 0, proxyAttempts)
+	for _, candidate := range ranked {
+		if len(candidates) == max(proxyAttempts, 1) {
+			break
+		}
+		candidates = append(candidates, candidate.Node)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			if prefix != "" {
+				pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+			}
+		},
+		Transport:     &failoverTransport{candidates: candidates, path: path, client: filter.Client, source: filter.Source, pin: pin},
+		FlushInterval: -1, // Stream responses as they arrive
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Error proxying %s: %v\n", r.URL.Path, err)
+			if errors.Is(err, errNoCandidateLeft) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(assignmentTTL.Seconds()/10)))
+				http.Error(w, "All matching nodes are at capacity", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "No node could serve the request", http.StatusBadGateway)
+		},
+	}
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// Client location for proxied requests: ?lat=&lon=, the X-Client-Lat/X-Client-Lon headers, or the geo-IP table
+func clientLocation(r *http.Request) (float64, float64, error) {
+	latValue, lonValue := r.URL.Query().Get("lat"), r.URL.Query().Get("lon")
+	if latValue == "" || lonValue == "" {
+		latValue, lonValue = r.Header.Get("X-Client-Lat"), r.Header.Get("X-Client-Lon")
+	}
+	if latValue == "" || lonValue == "" {
+		if location, _, ok := lookupGeoIP(requestIP(r)); ok {
+			return location.Lat, location.Lon, nil
+		}
+		return 0, 0, fmt.Errorf("Missing client location (lat/lon query parameters or X-Client-Lat/X-Client-Lon headers)")
+	}
+	lat, latErr := strconv.ParseFloat(latValue, 64)
+	lon, lonErr := strconv.ParseFloat(lonValue, 64)
+	if latErr != nil || lonErr != nil {
+		return 0, 0, fmt.Errorf("Invalid client location")
+	}
+	return lat, lon, validateCoordinates(lat, lon)
+}
+
+// Receive Handler
+func receiveHandler(w http.ResponseWriter, r *http.Request) {
+	// Simulate processing the request
+	response := map[string]string{
+		"status":  "ok",
+		"message": "Request received and processed",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Location of a network in the offline geo-IP table
+type geoLocation struct {
+	Lat     float64
+	Lon     float64
+	Country string // ISO country code, if the table has one
+}
+
+// Offline geo-IP table loaded from GEOIP_FILE, keyed by prefix length (in IPv6 bits) and masked network address
+var (
+	geoIPNetworks = make(map[int]map[string]geoLocation)
+	geoIPPrefixes []int // Prefix lengths present in the table, longest first
+)
+
+// Load the geo-IP table (network,latitude,longitude[,country] rows, e.g. 203.0.113.0/24,52.52,13.40,DE), if there is one
+func loadGeoIP() error {
+	path := envString("GEOIP_FILE", filepath.Join(registryFolder, "geoip.csv"))
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", path, err)
+		}
+		if len(record) < 3 {
+			continue
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(record[0]))
+		if err != nil {
+			continue // Header row or a malformed network
+		}
+		lat, latErr := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		lon, lonErr := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if latErr != nil || lonErr != nil || validateCoordinates(lat, lon) != nil {
+			log.Printf("Skipping geo-IP row with invalid location: %v\n", record)
+			continue
+		}
+		location := geoLocation{Lat: lat, Lon: lon}
+		if len(record) > 3 {
+			location.Country = strings.ToUpper(strings.TrimSpace(record[3]))
+		}
+
+		ones, bits := network.Mask.Size()
+		length := ones + 128 - bits // IPv4 networks live under ::ffff:0:0/96
+		if geoIPNetworks[length] == nil {
+			geoIPNetworks[length] = make(map[string]geoLocation)
+			geoIPPrefixes = append(geoIPPrefixes, length)
+		}
+		geoIPNetworks[length][string(network.IP.To16())] = location
+		count++
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(geoIPPrefixes)))
+	fmt.Printf("Loaded %d geo-IP networks\n", count)
+	return nil
+}
+
+// Find the most specific geo-IP network containing an address; the prefix length is in the address's own family
+func lookupGeoIP(ip net.IP) (geoLocation, int, bool) {
+	address := ip.To16()
+	if address == nil {
+		return geoLocation{}, 0, false
+	}
+	offset := 0
+	if ip.To4() != nil {
+		offset = 96
+	}
+	for _, length := range geoIPPrefixes {
+		if length < offset {
+			break // Shorter prefixes are IPv6 networks
+		}
+		if location, ok := geoIPNetworks[length][string(address.Mask(net.CIDRMask(length, 128)))]; ok {
+			return location, length - offset, true
+		}
+	}
+	return geoLocation{}, 0, false
+}
+
+// Proxies whose X-Forwarded-For entries are believed (TRUSTED_PROXIES, IPs or CIDRs, loopback by default)
+var trustedProxies = parseTrustedProxies(strings.Split(envString("TRUSTED_PROXIES", "127.0.0.1,::1"), ","))
+
+// Parse a list of IPs and CIDR ranges, skipping invalid entries
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q\n", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Check whether an address belongs to a trusted proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address of the client behind an HTTP request. X-Forwarded-For is only followed through trusted
+// proxies: walking it from the right, the first address that is not a trusted proxy is the client.
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// DNS settings: the main server can answer queries for a zone with the best node for the asking client
+var (
+	dnsAddr            = os.Getenv("DNS_ADDR")                                                              // UDP address for DNS, e.g. :5353 (empty disables it)
+	dnsZone            = strings.ToLower(strings.Trim(envString("DNS_ZONE", "nodes.nodepulse.local"), ".")) // Zone answered with nodes
+	dnsTTL             = envDuration("DNS_TTL", 30*time.Second)                                             // TTL of answers, kept short so clients follow fleet changes
+	dnsDefaultLocation = envString("DNS_DEFAULT_LOCATION", "0,0")                                           // "lat,lon" used for clients the geo-IP table does not know
+	dnsDefaultLat      float64
+	dnsDefaultLon      float64
+)
+
+// DNS wire constants
+const (
+	dnsTypeA          = 1
+	dnsTypeCNAME      = 5
+	dnsTypeSOA        = 6
+	dnsTypeAAAA       = 28
+	dnsTypeOPT        = 41
+	dnsTypeANY        = 255
+	dnsClassIN        = 1
+	dnsRcodeFormErr   = 1
+	dnsRcodeNXDomain  = 3
+	dnsRcodeNotImp    = 4
+	dnsRcodeRefused   = 5
+	ednsClientSubnet  = 8    // EDNS option carrying the client's subnet (RFC 7871)
+	dnsMaxUDPSize     = 1232 // Payload size advertised in EDNS responses
+	dnsPlainUDPLimit  = 512  // Largest response for clients without EDNS
+	dnsMaxCompression = 16   // Compression pointers followed in one name before giving up
+)
+
+// Client subnet sent by a resolver in the EDNS Client Subnet option
+type dnsClientSubnet struct {
+	Family       uint16 // 1 = IPv4, 2 = IPv6
+	SourcePrefix uint8
+	Address      net.IP
 }
 
-// Long Polling Handler
-func longPollHandler(w http.ResponseWriter, r *http.Request) {
-	// Simulate a long polling response
-	time.Sleep(10 * time.Second) // Simulate a delay
+// The parts of a DNS query the responder needs
+type dnsQuery struct {
+	ID       uint16
+	Flags    uint16
+	Name     string
+	Type     uint16
+	Class    uint16
+	Question []byte // Question section as sent, echoed in the response
+	EDNS     bool
+	Subnet   *dnsClientSubnet
+}
 
-	response := map[string]string{
-		"status":  "ok",
-		"message": "Long polling response",
+// Resource record in a response; a nil Name points back at the question name
+type dnsRecord struct {
+	Name []byte
+	Type uint16
+	Data []byte
+}
+
+// Read a possibly compressed name, returning it and the offset just past it
+func readDNSName(packet []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1 // Where the name ends once a compression pointer has been followed
+	for jumps := 0; ; {
+		if offset >= len(packet) {
+			return "", 0, fmt.Errorf("name runs past the end of the packet")
+		}
+		length := int(packet[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(packet) || jumps == dnsMaxCompression {
+				return "", 0, fmt.Errorf("bad compression pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(packet[offset:]) & 0x3FFF)
+			jumps++
+		case length&0xC0 != 0:
+			return "", 0, fmt.Errorf("unsupported label type")
+		default:
+			if offset+1+length > len(packet) {
+				return "", 0, fmt.Errorf("label runs past the end of the packet")
+			}
+			labels = append(labels, string(packet[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// Encode a name without compression
+func encodeDNSName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			continue
+		}
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
 }
 
-// Receive Handler
-func receiveHandler(w http.ResponseWriter, r *http.Request) {
-	// Simulate processing the request
-	response := map[string]string{
-		"status":  "ok",
-		"message": "Request received and processed",
+// Parse a query; a non-nil query with an error can still be answered with FORMERR
+func parseDNSQuery(packet []byte) (*dnsQuery, error) {
+	if len(packet) < 12 {
+		return nil, fmt.Errorf("packet shorter than a DNS header")
+	}
+	query := &dnsQuery{ID: binary.BigEndian.Uint16(packet), Flags: binary.BigEndian.Uint16(packet[2:])}
+	if query.Flags&0x8000 != 0 {
+		return nil, fmt.Errorf("packet is a response")
+	}
+	if binary.BigEndian.Uint16(packet[4:]) != 1 {
+		return query, fmt.Errorf("expected exactly one question")
+	}
+	name, offset, err := readDNSName(packet, 12)
+	if err != nil {
+		return query, err
+	}
+	if offset+4 > len(packet) {
+		return query, fmt.Errorf("question runs past the end of the packet")
+	}
+	query.Name = strings.ToLower(name)
+	query.Type = binary.BigEndian.Uint16(packet[offset:])
+	query.Class = binary.BigEndian.Uint16(packet[offset+2:])
+	query.Question = packet[12 : offset+4]
+	offset += 4
+
+	// Skip any answer and authority records, then look for the OPT record among the additional ones
+	preceding := int(binary.BigEndian.Uint16(packet[6:])) + int(binary.BigEndian.Uint16(packet[8:]))
+	records := preceding + int(binary.BigEndian.Uint16(packet[10:]))
+	for i := 0; i < records; i++ {
+		if _, offset, err = readDNSName(packet, offset); err != nil {
+			return query, err
+		}
+		if offset+10 > len(packet) {
+			return query, fmt.Errorf("record runs past the end of the packet")
+		}
+		recordType := binary.BigEndian.Uint16(packet[offset:])
+		start := offset + 10
+		end := start + int(binary.BigEndian.Uint16(packet[offset+8:]))
+		if end > len(packet) {
+			return query, fmt.Errorf("record data runs past the end of the packet")
+		}
+		if recordType == dnsTypeOPT && i >= preceding {
+			query.EDNS = true
+			query.Subnet = parseClientSubnet(packet[start:end])
+		}
+		offset = end
+	}
+	return query, nil
+}
+
+// Find the EDNS Client Subnet option among an OPT record's options
+func parseClientSubnet(options []byte) *dnsClientSubnet {
+	for len(options) >= 4 {
+		code := binary.BigEndian.Uint16(options)
+		length := int(binary.BigEndian.Uint16(options[2:]))
+		if 4+length > len(options) {
+			return nil
+		}
+		data := options[4 : 4+length]
+		options = options[4+length:]
+		if code != ednsClientSubnet || len(data) < 4 {
+			continue
+		}
+
+		subnet := &dnsClientSubnet{Family: binary.BigEndian.Uint16(data), SourcePrefix: data[2]}
+		switch subnet.Family {
+		case 1:
+			subnet.Address = make(net.IP, net.IPv4len)
+		case 2:
+			subnet.Address = make(net.IP, net.IPv6len)
+		default:
+			return nil
+		}
+		copy(subnet.Address, data[4:]) // Resolvers send only the prefix bytes
+		return subnet
+	}
+	return nil
+}
+
+// Parse DNS_DEFAULT_LOCATION ("lat,lon")
+func parseDefaultLocation() error {
+	parts := strings.Split(dnsDefaultLocation, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("expected lat,lon, got %q", dnsDefaultLocation)
+	}
+	lat, latErr := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, lonErr := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if latErr != nil || lonErr != nil {
+		return fmt.Errorf("expected lat,lon, got %q", dnsDefaultLocation)
+	}
+	if err := validateCoordinates(lat, lon); err != nil {
+		return err
+	}
+	dnsDefaultLat, dnsDefaultLon = lat, lon
+	return nil
+}
+
+// Locate a DNS client: its EDNS Client Subnet, then the resolver's address, then DNS_DEFAULT_LOCATION.
+// The prefix length is the ECS scope the answer is valid for.
+func dnsClientLocation(query *dnsQuery, source net.IP) (float64, float64, int) {
+	if query.Subnet != nil {
+		if location, length, ok := lookupGeoIP(query.Subnet.Address); ok {
+			return location.Lat, location.Lon, length
+		}
+	}
+	if location, _, ok := lookupGeoIP(source); ok {
+		return location.Lat, location.Lon, 0
+	}
+	return dnsDefaultLat, dnsDefaultLon, 0
+}
+
+// Record pointing at the best node for a client that fits the query type: A/AAAA for nodes registered by IP,
+// CNAME for nodes registered by hostname (e.g. tunnels)
+func dnsNodeRecord(lat, lon float64, filter nodeFilter, queryType uint16) (dnsRecord, bool) {
+	for _, candidate := range rankNodes(lat, lon, filter, routingCandidates) {
+		host := candidate.Node.IPAddress
+		if strings.Contains(host, "://") {
+			parsed, err := url.Parse(host)
+			if err != nil {
+				continue
+			}
+			host = parsed.Hostname()
+		}
+
+		ip := net.ParseIP(host)
+		switch {
+		case ip == nil:
+			return dnsRecord{Type: dnsTypeCNAME, Data: encodeDNSName(host)}, true
+		case ip.To4() != nil && (queryType == dnsTypeA || queryType == dnsTypeANY):
+			return dnsRecord{Type: dnsTypeA, Data: ip.To4()}, true
+		case ip.To4() == nil && (queryType == dnsTypeAAAA || queryType == dnsTypeANY):
+			return dnsRecord{Type: dnsTypeAAAA, Data: ip.To16()}, true
+		}
+	}
+	return dnsRecord{}, false
+}
+
+// SOA record for the zone, carried in negative answers so resolvers know how long to cache them
+func dnsSOARecord() dnsRecord {
+	mutex.RLock()
+	serial := uint32(registrySeq)
+	mutex.RUnlock()
+
+	data := append(encodeDNSName("ns."+dnsZone), encodeDNSName("hostmaster."+dnsZone)...)
+	for _, value := range []uint32{serial, 3600, 600, 86400, uint32(dnsTTL.Seconds())} {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return dnsRecord{Name: encodeDNSName(dnsZone), Type: dnsTypeSOA, Data: data}
+}
+
+// Answer one DNS query; nil means the packet is not worth answering
+func answerDNS(packet []byte, source net.IP) []byte {
+	query, err := parseDNSQuery(packet)
+	if query == nil {
+		return nil
+	}
+	if err != nil {
+		return buildDNSResponse(query, dnsRcodeFormErr, nil, nil, 0)
+	}
+	if query.Flags>>11&0xF != 0 {
+		return buildDNSResponse(query, dnsRcodeNotImp, nil, nil, 0) // Only standard queries
+	}
+	if query.Class != dnsClassIN || (query.Name != dnsZone && !strings.HasSuffix(query.Name, "."+dnsZone)) {
+		return buildDNSResponse(query, dnsRcodeRefused, nil, nil, 0)
+	}
+
+	// The zone apex answers with the best node; <capability>.<zone> only with nodes offering that capability
+	filter := nodeFilter{}
+	if query.Name != dnsZone {
+		capability := strings.TrimSuffix(query.Name, "."+dnsZone)
+		if strings.Contains(capability, ".") {
+			return buildDNSResponse(query, dnsRcodeNXDomain, nil, []dnsRecord{dnsSOARecord()}, 0)
+		}
+		filter.Capabilities = []string{capability}
+	}
+
+	lat, lon, scope := dnsClientLocation(query, source)
+	filter.Fence = geofenceFor("", lat, lon)
+	filter.Client = "dns/" + source.String() // Skips full nodes; resolvers are not counted as clients
+	switch query.Type {
+	case dnsTypeA, dnsTypeAAAA, dnsTypeCNAME, dnsTypeANY:
+		if record, ok := dnsNodeRecord(lat, lon, filter, query.Type); ok {
+			return buildDNSResponse(query, 0, []dnsRecord{record}, nil, scope)
+		}
+	case dnsTypeSOA:
+		if query.Name == dnsZone {
+			return buildDNSResponse(query, 0, []dnsRecord{dnsSOARecord()}, nil, scope)
+		}
+	}
+	// No node fits: an empty answer
+	return buildDNSResponse(query, 0, nil, []dnsRecord{dnsSOARecord()}, scope)
+}
+
+// Assemble a response to a query
+func buildDNSResponse(query *dnsQuery, rcode uint16, answers, authority []dnsRecord, scope int) []byte {
+	flags := 0x8000 | query.Flags&0x7900 | rcode // QR, plus the query's opcode and RD bit
+	if rcode != dnsRcodeRefused {
+		flags |= 0x0400 // Authoritative
+	}
+	questions := uint16(0)
+	if query.Question != nil {
+		questions = 1
+	}
+	additional := uint16(0)
+	if query.EDNS {
+		additional = 1
+	}
+
+	packet := binary.BigEndian.AppendUint16(nil, query.ID)
+	for _, value := range []uint16{flags, questions, uint16(len(answers)), uint16(len(authority)), additional} {
+		packet = binary.BigEndian.AppendUint16(packet, value)
+	}
+	packet = append(packet, query.Question...)
+	for _, record := range append(answers, authority...) {
+		name := record.Name
+		if name == nil {
+			name = []byte{0xC0, 12} // Pointer to the question name
+		}
+		packet = append(packet, name...)
+		packet = binary.BigEndian.AppendUint16(packet, record.Type)
+		packet = binary.BigEndian.AppendUint16(packet, dnsClassIN)
+		packet = binary.BigEndian.AppendUint32(packet, uint32(dnsTTL.Seconds()))
+		packet = binary.BigEndian.AppendUint16(packet, uint16(len(record.Data)))
+		packet = append(packet, record.Data...)
+	}
+
+	if query.EDNS {
+		var options []byte
+		if subnet := query.Subnet; subnet != nil {
+			// Echo the client subnet with the scope the answer holds for
+			address := subnet.Address[:min(len(subnet.Address), (int(subnet.SourcePrefix)+7)/8)]
+			options = binary.BigEndian.AppendUint16(options, ednsClientSubnet)
+			options = binary.BigEndian.AppendUint16(options, uint16(4+len(address)))
+			options = binary.BigEndian.AppendUint16(options, subnet.Family)
+			options = append(options, subnet.SourcePrefix, byte(scope))
+			options = append(options, address...)
+		}
+		packet = append(packet, 0) // Root name
+		packet = binary.BigEndian.AppendUint16(packet, dnsTypeOPT)
+		packet = binary.BigEndian.AppendUint16(packet, dnsMaxUDPSize)
+		packet = binary.BigEndian.AppendUint32(packet, 0)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(len(options)))
+		packet = append(packet, options...)
+	} else if len(packet) > dnsPlainUDPLimit {
+		// Too big for plain DNS over UDP: send only the header and question, marked truncated
+		packet = packet[:12+len(query.Question)]
+		binary.BigEndian.PutUint16(packet[2:], flags|0x0200)
+		for i := 6; i < 12; i++ {
+			packet[i] = 0
+		}
+	}
+	return packet
+}
+
+// Answer DNS queries over UDP on DNS_ADDR
+func serveDNS() {
+	conn, err := net.ListenPacket("udp", dnsAddr)
+	if err != nil {
+		log.Printf("Error starting DNS server: %v\n", err)
+		return
+	}
+	fmt.Println("DNS server answering for", dnsZone, "on", dnsAddr)
+
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			log.Printf("Error reading DNS query: %v\n", err)
+			continue
+		}
+		packet := append([]byte(nil), buffer[:n]...)
+		go func() {
+			var source net.IP
+			if udpAddr, ok := addr.(*net.UDPAddr); ok {
+				source = udpAddr.IP
+			}
+			if response := answerDNS(packet, source); response != nil {
+				if _, err := conn.WriteTo(response, addr); err != nil {
+					log.Printf("Error sending DNS response: %v\n", err)
+				}
+			}
+		}()
+	}
+}
+
+// Simulation limits
+const (
+	maxSimulatedClients  = 20000   // Most clients a single simulation may place
+	maxSimulationRequest = 1 << 20 // Largest accepted scenario body
+)
+
+var (
+	adminKey        = os.Getenv("ADMIN_KEY") // Bearer token for operator endpoints such as /simulate (empty disables them)
+	simulationSlots = make(chan struct{}, 1) // Simulations run one at a time
+)
+
+// What-if scenario: a fleet (the registry with nodes added or removed) and the clients to route over it
+type simulationRequest struct {
+	Add             []Node            `json:"add,omitempty"`              // Hypothetical nodes; active unless they say otherwise
+	Remove          []string          `json:"remove,omitempty"`           // IDs of registered nodes to leave out
+	WithoutRegistry bool              `json:"without_registry,omitempty"` // Start from an empty fleet instead of the registry
+	Clients         []simulatedClient `json:"clients,omitempty"`          // Recorded client locations
+	Synthetic       *syntheticClients `json:"synthetic,omitempty"`        // Generated client locations, added to the recorded ones
+	Strategy        string            `json:"strategy,omitempty"`         // Routing strategy; ROUTING_STRATEGY if empty
+	DistanceModel   string            `json:"distance_model,omitempty"`   // Distance model; DISTANCE_MODEL if empty
+	Tenant          string            `json:"tenant,omitempty"`           // Tenant whose geofence rules apply
+	Capabilities    []string          `json:"capabilities,omitempty"`     // Capabilities the clients need
+	ThresholdKm     float64           `json:"threshold_km,omitempty"`     // Distance beyond which a client counts as badly served (default 1000)
+}
+
+// Client location, optionally standing for several clients
+type simulatedClient struct {
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Weight float64 `json:"weight,omitempty"` // Default 1
+}
+
+// Synthetic client population: clusters around centers, or spread over the globe when there are none
+type syntheticClients struct {
+	Count   int                `json:"count"`
+	Seed    int64              `json:"seed,omitempty"`
+	Centers []populationCenter `json:"centers,omitempty"`
+}
+
+// Cluster of synthetic clients spread evenly over a disc
+type populationCenter struct {
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	RadiusKm float64 `json:"radius_km"`
+	Weight   float64 `json:"weight,omitempty"` // Share of the clients relative to the other centers (default 1)
+}
+
+// How a fleet served the clients
+type simulationSummary struct {
+	Nodes           int                    `json:"nodes"` // Active nodes in the fleet
+	Clients         float64                `json:"clients"`
+	Unserved        float64                `json:"unserved"` // Clients no node could take
+	MeanDistanceKm  float64                `json:"mean_distance_km"`
+	P95DistanceKm   float64                `json:"p95_distance_km"`
+	BeyondThreshold float64                `json:"beyond_threshold"` // Clients sent farther than threshold_km
+	PerNode         []simulationNodeResult `json:"per_node"`
+}
+
+// How one node fared in a simulation
+type simulationNodeResult struct {
+	ID             string  `json:"id"`
+	Added          bool    `json:"added,omitempty"`
+	Clients        float64 `json:"clients"`
+	Share          float64 `json:"share"`
+	MeanDistanceKm float64 `json:"mean_distance_km"`
+	P95DistanceKm  float64 `json:"p95_distance_km"`
+}
+
+// Distance a client was sent, with the number of clients it stands for
+type distanceSample struct {
+	Km     float64
+	Weight float64
+}
+
+// Build the client population of a scenario
+func simulationClients(request simulationRequest) ([]simulatedClient, error) {
+	clients := append([]simulatedClient(nil), request.Clients...)
+	for _, client := range clients {
+		if err := validateCoordinates(client.Lat, client.Lon); err != nil {
+			return nil, err
+		}
+	}
+	if synthetic := request.Synthetic; synthetic != nil {
+		if synthetic.Count < 0 {
+			return nil, fmt.Errorf("synthetic count must not be negative")
+		}
+		for _, center := range synthetic.Centers {
+			if err := validateCoordinates(center.Lat, center.Lon); err != nil {
+				return nil, err
+			}
+		}
+		random := mathrand.New(mathrand.NewSource(synthetic.Seed))
+		total := 0.0
+		for _, center := range synthetic.Centers {
+			total += center.weight()
+		}
+		for i := 0; i < synthetic.Count && len(clients) <= maxSimulatedClients; i++ {
+			if len(synthetic.Centers) == 0 {
+				// Uniform over the sphere
+				clients = append(clients, simulatedClient{
+					Lat: math.Asin(2*random.Float64()-1) * 180 / math.Pi,
+					Lon: random.Float64()*360 - 180,
+				})
+				continue
+			}
+			pick, center := random.Float64()*total, synthetic.Centers[len(synthetic.Centers)-1]
+			for _, candidate := range synthetic.Centers {
+				pick -= candidate.weight()
+				if pick < 0 {
+					center = candidate
+					break
+				}
+			}
+			lat, lon := destinationPoint(center.Lat, center.Lon, random.Float64()*360, center.RadiusKm*math.Sqrt(random.Float64()))
+			clients = append(clients, simulatedClient{Lat: lat, Lon: lon})
+		}
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no clients: give clients or synthetic")
+	}
+	if len(clients) > maxSimulatedClients {
+		return nil, fmt.Errorf("too many clients, at most %d", maxSimulatedClients)
+	}
+	for i := range clients {
+		if clients[i].Weight <= 0 {
+			clients[i].Weight = 1
+		}
+	}
+	return clients, nil
+}
+
+// Relative share of a center's clients; centers without a weight count as 1
+func (center populationCenter) weight() float64 {
+	if center.Weight <= 0 {
+		return 1
+	}
+	return center.Weight
+}
+
+// Point reached going distanceKm from a start point along a bearing (degrees from north)
+func destinationPoint(lat, lon, bearing, distanceKm float64) (float64, float64) {
+	const earthRadius = 6371
+	phi, lambda, theta := lat*math.Pi/180, lon*math.Pi/180, bearing*math.Pi/180
+	delta := distanceKm / earthRadius
+	phi2 := math.Asin(math.Sin(phi)*math.Cos(delta) + math.Cos(phi)*math.Sin(delta)*math.Cos(theta))
+	lambda2 := lambda + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(phi), math.Cos(delta)-math.Sin(phi)*math.Sin(phi2))
+	return phi2 * 180 / math.Pi, math.Mod(lambda2*180/math.Pi+540, 360) - 180
+}
+
+// Weighted percentile (0-1) of distances, sorting the samples in place
+func distancePercentile(samples []distanceSample, percentile float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Km < samples[j].Km })
+	total := 0.0
+	for _, sample := range samples {
+		total += sample.Weight
+	}
+	seen := 0.0
+	for _, sample := range samples {
+		seen += sample.Weight
+		if seen >= percentile*total {
+			return sample.Km
+		}
+	}
+	return samples[len(samples)-1].Km
+}
+
+// Route every client over a fleet with its own instance of a strategy and summarize where they went
+func simulateFleet(fleet fleetView, strategy RoutingStrategy, clients []simulatedClient, request simulationRequest, added map[string]bool) simulationSummary {
+	strategy = freshStrategy(strategy)
+	summary := simulationSummary{}
+	for _, node := range fleet.Nodes {
+		if node.Status == "active" {
+			summary.Nodes++
+		}
+	}
+	perNode := make(map[string][]distanceSample)
+	var all []distanceSample
+	now := time.Now()
+	for _, client := range clients {
+		summary.Clients += client.Weight
+		filter := nodeFilter{Capabilities: normalizeLabels(request.Capabilities), Fence: geofenceFor(request.Tenant, client.Lat, client.Lon)}
+		ranked := strategy.Rank(routingRequest{Lat: client.Lat, Lon: client.Lon, Filter: filter, Count: 1, Now: now, Fleet: fleet, Model: request.DistanceModel})
+		if len(ranked) == 0 {
+			summary.Unserved += client.Weight
+			continue
+		}
+		sample := distanceSample{Km: ranked[0].DistanceKm, Weight: client.Weight}
+		perNode[ranked[0].Node.ID] = append(perNode[ranked[0].Node.ID], sample)
+		all = append(all, sample)
+		summary.MeanDistanceKm += sample.Km * sample.Weight
+		if sample.Km > request.ThresholdKm {
+			summary.BeyondThreshold += sample.Weight
+		}
+	}
+
+	if served := summary.Clients - summary.Unserved; served > 0 {
+		summary.MeanDistanceKm /= served
+	}
+	summary.P95DistanceKm = distancePercentile(all, 0.95)
+	for id, samples := range perNode {
+		result := simulationNodeResult{ID: id, Added: added[id]}
+		for _, sample := range samples {
+			result.Clients += sample.Weight
+			result.MeanDistanceKm += sample.Km * sample.Weight
+		}
+		result.MeanDistanceKm /= result.Clients
+		result.Share = result.Clients / summary.Clients
+		result.P95DistanceKm = distancePercentile(samples, 0.95)
+		summary.PerNode = append(summary.PerNode, result)
+	}
+	sort.Slice(summary.PerNode, func(i, j int) bool {
+		if summary.PerNode[i].Clients != summary.PerNode[j].Clients {
+			return summary.PerNode[i].Clients > summary.PerNode[j].Clients
+		}
+		return summary.PerNode[i].ID < summary.PerNode[j].ID
+	})
+	return summary
+}
+
+// Run a scenario against a copy of the registry: the current fleet as baseline, then the modified one
+func runSimulation(request simulationRequest) (map[string]interface{}, error) {
+	name := request.Strategy
+	if name == "" {
+		name = defaultStrategyName
+	}
+	strategy, ok := routingStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown routing strategy %q", name)
+	}
+	if request.ThresholdKm <= 0 {
+		request.ThresholdKm = 1000
+	}
+	model, err := validDistanceModel(request.DistanceModel)
+	if err != nil {
+		return nil, err
+	}
+	request.DistanceModel = model
+	clients, err := simulationClients(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the registry and the open breakers so routing keeps running while the simulation does,
+	// and nothing the simulation does reaches the live state
+	mutex.RLock()
+	baseline := fleetView{Nodes: make(map[string]Node, len(nodes)), Index: newSpatialIndex(), Simulated: true}
+	for id, node := range nodes {
+		baseline.Nodes[id] = node
+		baseline.Index.put(id, node.Latitude, node.Longitude)
+	}
+	mutex.RUnlock()
+	baseline.Open = openBreakers(time.Now())
+
+	scenario := fleetView{Nodes: make(map[string]Node), Index: newSpatialIndex(), Simulated: true, Open: baseline.Open}
+	if !request.WithoutRegistry {
+		removed := make(map[string]bool)
+		for _, id := range request.Remove {
+			removed[id] = true
+		}
+		for id, node := range baseline.Nodes {
+			if !removed[id] {
+				scenario.Nodes[id] = node
+				scenario.Index.put(id, node.Latitude, node.Longitude)
+			}
+		}
+	}
+	added := make(map[string]bool)
+	for i, node := range request.Add {
+		if node.ID == "" {
+			node.ID = fmt.Sprintf("added-%d", i+1)
+		}
+		if err := validateCoordinates(node.Latitude, node.Longitude); err != nil {
+			return nil, fmt.Errorf("node %s: %v", node.ID, err)
+		}
+		if node.Status == "" {
+			node.Status = "active"
+		}
+		if len(node.Capabilities) == 0 {
+			node.Capabilities = defaultCapabilities
+		}
+		node.Capabilities, node.Tags = normalizeLabels(node.Capabilities), normalizeLabels(node.Tags)
+		scenario.Nodes[node.ID] = node
+		scenario.Index.put(node.ID, node.Latitude, node.Longitude)
+		added[node.ID] = true
+	}
+
+	return map[string]interface{}{
+		"strategy":       strategy.Name(),
+		"distance_model": request.DistanceModel,
+		"threshold_km":   request.ThresholdKm,
+		"baseline":       simulateFleet(baseline, strategy, clients, request, nil),
+		"scenario":       simulateFleet(scenario, strategy, clients, request, added),
+	}, nil
+}
+
+// Require the ADMIN_KEY bearer token on operator endpoints
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminKey == "" {
+			http.Error(w, "Operator endpoints are disabled: set ADMIN_KEY", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !hmac.Equal([]byte(token), []byte(adminKey)) {
+			logToActiveLog("Rejected operator request", map[string]string{"path": r.URL.Path, "remote": r.RemoteAddr})
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Simulate Handler (POST /simulate: how traffic would shift with nodes added or removed)
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case simulationSlots <- struct{}{}:
+		defer func() { <-simulationSlots }()
+	default:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Another simulation is running", http.StatusTooManyRequests)
+		return
+	}
+
+	var request simulationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSimulationRequest)).Decode(&request); err != nil {
+		http.Error(w, "Invalid simulation request", http.StatusBadRequest)
+		return
+	}
+	result, err := runSimulation(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Run a scenario file against the saved registry (every saved node counted as active) and print the result
+func simulateFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var request simulationRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	mutex.Lock()
+	_, err = readRegistry()
+	for _, node := range nodes {
+		node.Status = "active"
+		putNode(node)
+	}
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := loadGeofence(); err != nil {
+		return err
+	}
+
+	result, err := runSimulation(request)
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
 }
 
 func main() {
+	simulate := flag.String("simulate", "", "run the simulation scenario in this JSON file against the saved registry, then exit")
+	flag.Parse()
+	if defaultDistanceModel != "haversine" && defaultDistanceModel != "vincenty" {
+		log.Printf("Unknown DISTANCE_MODEL %q, using haversine\n", defaultDistanceModel)
+		defaultDistanceModel = "haversine"
+	}
+	if *simulate != "" {
+		if err := simulateFromFile(*simulate); err != nil {
+			log.Fatalf("Simulation failed: %v", err)
+		}
+		return
+	}
+
 	// Initialize CORS settings
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"}, // Allow all origins
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-Node-Key-Id", "X-Node-Timestamp", "X-Node-Signature", "X-Client-Lat", "X-Client-Lon"},
 		AllowCredentials: true,
 	})
 
 	// Register handlers
-	http.HandleFunc("/register-node", registerNodeHandler)
+	http.HandleFunc("/register-node", withPrimaryForwarding(withNodeAuth(withRequiredCertificate(registerNodeHandler))))
+	http.HandleFunc("/heartbeat", withPrimaryForwarding(withNodeAuth(withRequiredCertificate(heartbeatHandler))))
+	http.HandleFunc("/drain-node", withPrimaryForwarding(withNodeAuth(withRequiredCertificate(drainNodeHandler))))
+	http.HandleFunc("/deregister-node", withPrimaryForwarding(withNodeAuth(withRequiredCertificate(deregisterNodeHandler))))
+	http.HandleFunc("/enroll-node", withNodeAuth(enrollNodeHandler))
+	http.HandleFunc("/probe-status", probeStatusHandler)
+	http.HandleFunc("/nodes", listNodesHandler)
+	http.HandleFunc("/nodes/{id}", getNodeHandler)
 	http.HandleFunc("/redirect-client", redirectClientHandler)
 	http.HandleFunc("/long-poll", longPollHandler)
-	http.HandleFunc("/receive", receiveHandler)
+	if proxyMode {
+		http.HandleFunc("/receive", proxyHandler)
+		http.HandleFunc("/upload", proxyHandler)
+	} else {
+		http.HandleFunc("/receive", receiveHandler)
+	}
+	http.HandleFunc("/proxy/", proxyHandler)
+	http.HandleFunc("/simulate", withAdminAuth(simulateHandler))
+	http.HandleFunc("/fleet-key", fleetKeyHandler)
+	http.HandleFunc("/report-rtt", reportRTTHandler)
+	http.HandleFunc("/rtt-estimates", rttEstimatesHandler)
+	http.HandleFunc("/replica/status", withPeerAuth(replicaStatusHandler))
+	http.HandleFunc("/replica/append", withPeerAuth(replicaAppendHandler))
+	http.HandleFunc("/replica/install", withPeerAuth(replicaInstallHandler))
+	http.HandleFunc("/replica/snapshot", withPeerAuth(replicaSnapshotHandler))
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // fallback default if PORT is not set
 	}
 
+	// Load the keys nodes sign their control calls with
+	if allowUnauthenticated {
+		fmt.Println("WARNING: node authentication is disabled (ALLOW_UNAUTHENTICATED_NODES=true)")
+	} else if err := loadNodeKeys(); err != nil {
+		log.Printf("Error loading node keys, every node request will be rejected: %v\n", err)
+	}
+
+	// Restore the registry saved before the last restart
+	if err := loadRegistry(); err != nil {
+		log.Printf("Error restoring node registry, continuing in memory only: %v\n", err)
+	}
+
+	// Load the per-tenant routing strategies
+	if _, ok := routingStrategies[defaultStrategyName]; !ok {
+		log.Printf("Unknown ROUTING_STRATEGY %q, using weighted\n", defaultStrategyName)
+		defaultStrategyName = "weighted"
+	}
+	if err := loadTenantStrategies(); err != nil {
+		log.Printf("Error loading tenant routing strategies: %v\n", err)
+	}
+
+	// Load the offline geo-IP table used to locate clients that do not send coordinates
+	if err := loadGeoIP(); err != nil {
+		log.Printf("Error loading geo-IP table: %v\n", err)
+	}
+
+	// Load the data-residency rules; routing without them could send users' data where it must not go
+	if err := loadGeofence(); err != nil {
+		log.Fatalf("Error loading geofence rules: %v", err)
+	}
+
+	// Load the key fleet snapshots are signed with
+	if err := loadOrCreateFleetKey(); err != nil {
+		log.Printf("Error loading fleet signing key, redirects will not include a fleet snapshot: %v\n", err)
+	}
+
+	// Share the registry with the other main servers
+	if replicationEnabled() {
+		startReplication()
+	}
+
+	// Expire leases of nodes that stop sending heartbeats
+	go monitorLeases()
+
+	// Actively check that registered nodes are reachable
+	go probeNodes()
+
+	// Forget latency estimates nobody refreshes
+	go monitorRTTEstimates()
+
+	// Forget client pins that are no longer used
+	go monitorAffinities()
+
+	// End client assignments that have run out
+	go monitorAssignments()
+
+	// Answer DNS queries for the node zone
+	if dnsAddr != "" {
+		if err := parseDefaultLocation(); err != nil {
+			log.Printf("Invalid DNS_DEFAULT_LOCATION, using 0,0: %v\n", err)
+		}
+		go serveDNS()
+	}
+
 	fmt.Println("Main server is running on port", port)
 
+	// Serve node control calls over mutual TLS when enabled
+	if mtlsPort != "" {
+		if err := loadOrCreateCA(); err != nil {
+			log.Printf("Error loading CA, mTLS disabled: %v\n", err)
+		} else {
+			go serveMTLS(corsHandler.Handler(http.DefaultServeMux))
+		}
+	}
+
 	// Start the server with the given port
 	if err := http.ListenAndServe(":"+port, corsHandler.Handler(http.DefaultServeMux)); err != nil {
 		fmt.Println("Error starting server:", err)
@@ -0,0 +1,1943 @@
+//go:build !node
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run the tests in a scratch directory, so the logs and data files they write do not land in the repository
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mainserver-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Start from an empty registry, dropping whatever a previous test left behind
+func resetRegistry(t *testing.T, fleet ...Node) {
+	t.Helper()
+	mutex.Lock()
+	nodes = make(map[string]Node)
+	nodeIndex = newSpatialIndex()
+	probes = make(map[string]ProbeResult)
+	for _, node := range fleet {
+		putNode(node)
+	}
+	mutex.Unlock()
+
+	affinityMutex.Lock()
+	affinities = make(map[string]affinityPin)
+	pinnedClients = make(map[string]int)
+	affinityMutex.Unlock()
+
+	clientMutex.Lock()
+	clientAssignments = make(map[string]clientAssignment)
+	clientCount = make(map[string]int)
+	sourceSessions = make(map[string]int)
+	clientMutex.Unlock()
+
+	breakerMutex.Lock()
+	breakers = make(map[string]*CircuitBreaker)
+	breakerMutex.Unlock()
+}
+
+// Cluster centres for the test fleets
+var testCities = [][2]float64{
+	{40.71, -74.01}, {51.51, -0.13}, {35.68, 139.69}, {19.08, 72.88}, {-23.55, -46.63}, {-33.87, 151.21}, {1.35, 103.82}, {52.52, 13.40},
+}
+
+// Random fleet with most nodes clustered around a few cities, like a real fleet
+func testFleet(random *mathrand.Rand, size int) (map[string]Node, *spatialIndex) {
+	fleet := make(map[string]Node, size)
+	index := newSpatialIndex()
+	for i := 0; i < size; i++ {
+		lat, lon := random.Float64()*180-90, random.Float64()*360-180
+		if i%4 != 0 {
+			center := testCities[i%len(testCities)]
+			lat = max(-90, min(90, center[0]+random.NormFloat64()*2))
+			lon = center[1] + random.NormFloat64()*2
+		}
+		id := strconv.Itoa(i)
+		fleet[id] = Node{ID: id, Latitude: lat, Longitude: lon, Status: "active"}
+		index.put(id, lat, lon)
+	}
+	return fleet, index
+}
+
+// Nearest accepted node by scanning the whole fleet
+func linearNearest(fleet map[string]Node, lat, lon float64, accept func(id string) bool) (string, float64) {
+	best, bestDistance := "", math.MaxFloat64
+	for id, node := range fleet {
+		if !accept(id) {
+			continue
+		}
+		if distance := haversineDistance(lat, lon, node.Latitude, node.Longitude); distance < bestDistance {
+			best, bestDistance = id, distance
+		}
+	}
+	return best, bestDistance
+}
+
+func TestIndexMatchesLinearScan(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		accept func(id string) bool
+	}{
+		{"single node", 1, func(string) bool { return true }},
+		{"small fleet", 100, func(string) bool { return true }},
+		{"large fleet", 5000, func(string) bool { return true }},
+		{"filtered", 1000, func(id string) bool { n, _ := strconv.Atoi(id); return n%3 == 0 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			random := mathrand.New(mathrand.NewSource(1))
+			fleet, index := testFleet(random, test.size)
+			for i := 0; i < 500; i++ {
+				lat, lon := random.Float64()*180-90, random.Float64()*360-180
+				expected, expectedDistance := linearNearest(fleet, lat, lon, test.accept)
+				found := index.nearest(lat, lon, 1, test.accept)
+				if len(found) != 1 {
+					t.Fatalf("nearest(%v, %v) = %v, want one node", lat, lon, found)
+				}
+				// Ties may resolve either way, so compare distances rather than IDs
+				node := fleet[found[0]]
+				if distance := haversineDistance(lat, lon, node.Latitude, node.Longitude); math.Abs(distance-expectedDistance) > 1e-9 {
+					t.Fatalf("nearest(%v, %v) = %s at %.3f km, linear scan found %s at %.3f km", lat, lon, found[0], distance, expected, expectedDistance)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexOrdersResults(t *testing.T) {
+	random := mathrand.New(mathrand.NewSource(2))
+	fleet, index := testFleet(random, 2000)
+	found := index.nearest(48.85, 2.35, 20, func(string) bool { return true })
+	if len(found) != 20 {
+		t.Fatalf("got %d nodes, want 20", len(found))
+	}
+	previous := 0.0
+	for _, id := range found {
+		distance := haversineDistance(48.85, 2.35, fleet[id].Latitude, fleet[id].Longitude)
+		if distance < previous {
+			t.Fatalf("node %s at %.3f km comes after a node at %.3f km", id, distance, previous)
+		}
+		previous = distance
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	index := newSpatialIndex()
+	index.put("a", 10, 10)
+	index.put("b", 20, 20)
+	index.put("a", -10, -10) // Moving a node replaces its old entry
+	if found := index.nearest(10, 10, 2, func(string) bool { return true }); len(found) != 2 || found[0] != "b" {
+		t.Fatalf("nearest after move = %v, want [b a]", found)
+	}
+	index.remove("b")
+	index.remove("missing")
+	if found := index.nearest(10, 10, 2, func(string) bool { return true }); len(found) != 1 || found[0] != "a" {
+		t.Fatalf("nearest after remove = %v, want [a]", found)
+	}
+	index.remove("a")
+	if len(index.cells) != 0 || len(index.locations) != 0 {
+		t.Fatalf("index not empty after removing every node: %d cells, %d locations", len(index.cells), len(index.locations))
+	}
+}
+
+func benchmarkNearest(b *testing.B, lookup func(fleet map[string]Node, index *spatialIndex, lat, lon float64)) {
+	for _, size := range []int{100, 1000, 10000, 100000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			random := mathrand.New(mathrand.NewSource(1))
+			fleet, index := testFleet(random, size)
+			queries := make([][2]float64, 1024)
+			for i := range queries {
+				queries[i] = [2]float64{random.Float64()*180 - 90, random.Float64()*360 - 180}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				query := queries[i%len(queries)]
+				lookup(fleet, index, query[0], query[1])
+			}
+		})
+	}
+}
+
+func BenchmarkNearestLinearScan(b *testing.B) {
+	benchmarkNearest(b, func(fleet map[string]Node, index *spatialIndex, lat, lon float64) {
+		linearNearest(fleet, lat, lon, func(string) bool { return true })
+	})
+}
+
+func BenchmarkNearestIndex(b *testing.B) {
+	benchmarkNearest(b, func(fleet map[string]Node, index *spatialIndex, lat, lon float64) {
+		index.nearest(lat, lon, 1, func(string) bool { return true })
+	})
+}
+
+func TestClientIdentifier(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		cookie    string
+		userAgent string
+		want      string
+		issued    bool
+	}{
+		{"query parameter", "/redirect-client?client_id=abc", "", "", "abc", false},
+		{"query wins over cookie", "/redirect-client?client_id=abc", "def", "", "abc", false},
+		{"cookie", "/redirect-client", "def", "", "def", false},
+		{"oversized query", "/redirect-client?client_id=" + strings.Repeat("x", 129), "", "", "", false},
+		{"no identity", "/redirect-client", "", "Go-http-client/1.1", "", false},
+		{"browser without identity", "/redirect-client", "", "Mozilla/5.0", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: affinityCookie, Value: test.cookie})
+			}
+			r.Header.Set("User-Agent", test.userAgent)
+			if got := clientIdentifier(r); got != test.want {
+				t.Fatalf("clientIdentifier = %q, want %q", got, test.want)
+			}
+			if test.want != "" {
+				return
+			}
+			w := httptest.NewRecorder()
+			issued := issueClientCookie(w, r)
+			if (issued != "") != test.issued || (len(w.Result().Cookies()) > 0) != test.issued {
+				t.Fatalf("issueClientCookie = %q with cookies %v, want issued %v", issued, w.Result().Cookies(), test.issued)
+			}
+		})
+	}
+}
+
+func TestAffinityHashIsRendezvous(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d", "e"}
+	winner := func(clientID string, ids []string) string {
+		best := ids[0]
+		for _, id := range ids[1:] {
+			if affinityHash(clientID, id) > affinityHash(clientID, best) {
+				best = id
+			}
+		}
+		return best
+	}
+
+	wins := make(map[string]int)
+	for i := 0; i < 5000; i++ {
+		clientID := "client-" + strconv.Itoa(i)
+		chosen := winner(clientID, candidates)
+		wins[chosen]++
+
+		// Dropping a candidate that was not chosen never moves the client
+		for j, id := range candidates {
+			if id == chosen {
+				continue
+			}
+			rest := append(append([]string{}, candidates[:j]...), candidates[j+1:]...)
+			if moved := winner(clientID, rest); moved != chosen {
+				t.Fatalf("client %s moved from %s to %s when %s left", clientID, chosen, moved, id)
+			}
+		}
+	}
+	for _, id := range candidates {
+		if wins[id] < 800 || wins[id] > 1200 {
+			t.Fatalf("node %s won %d of 5000 clients, want about 1000", id, wins[id])
+		}
+	}
+}
+
+func TestApplyAffinity(t *testing.T) {
+	fleet := []Node{
+		{ID: "a", Latitude: 10, Longitude: 10, Status: "active"},
+		{ID: "b", Latitude: 10, Longitude: 10.01, Status: "active"},
+		{ID: "far", Latitude: -40, Longitude: 100, Status: "active"},
+	}
+	// Candidates as a strategy would rank them: active nodes only
+	ranked := func() []rankedNode {
+		var result []rankedNode
+		for i, score := range []float64{0, 0.01, 5} {
+			if node := nodes[fleet[i].ID]; node.Status == "active" {
+				result = append(result, rankedNode{Node: node, Score: score})
+			}
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		setup    func()
+		want     string
+		affinity string
+	}{
+		{"pinned node stays", func() {}, "", "pinned"},
+		{"inactive pin is replaced", func() {
+			mutex.Lock()
+			node := nodes[pinnedNode(t, "client")]
+			node.Status = "draining"
+			putNode(node)
+			mutex.Unlock()
+		}, "other", "assigned"},
+		{"distant pin is replaced", func() {
+			affinityMutex.Lock()
+			affinities["client"] = affinityPin{NodeID: "far"}
+			affinityMutex.Unlock()
+		}, "a or b", "assigned"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetRegistry(t, fleet...)
+			first, affinity := applyAffinity("client", "haversine", 10, 10, nodeFilter{}, ranked())
+			if affinity != "assigned" || first[0].Node.ID == "far" {
+				t.Fatalf("first request went to %s (%s), want a near node assigned", first[0].Node.ID, affinity)
+			}
+			if got := pinnedNode(t, "client"); got != "" {
+				t.Fatalf("client pinned to %s before it was assigned", got)
+			}
+			pinned := first[0].Node.ID
+			pinAssignedClient("client", pinned)
+
+			test.setup()
+			before := pinnedNode(t, "client")
+			second, affinity := applyAffinity("client", "haversine", 10, 10, nodeFilter{}, ranked())
+			if affinity != test.affinity {
+				t.Fatalf("affinity = %s, want %s", affinity, test.affinity)
+			}
+			switch test.want {
+			case "":
+				if second[0].Node.ID != pinned {
+					t.Fatalf("second request went to %s, want pinned node %s", second[0].Node.ID, pinned)
+				}
+			case "other":
+				if second[0].Node.ID == pinned || second[0].Node.ID == "far" {
+					t.Fatalf("second request went to %s, want the other near node", second[0].Node.ID)
+				}
+			default:
+				if second[0].Node.ID == "far" {
+					t.Fatalf("second request stayed on the distant node")
+				}
+			}
+			if got := pinnedNode(t, "client"); got != before {
+				t.Fatalf("ranking moved the pin to %s", got)
+			}
+		})
+	}
+}
+
+// Node a client is pinned to
+func pinnedNode(t *testing.T, clientID string) string {
+	t.Helper()
+	affinityMutex.Lock()
+	defer affinityMutex.Unlock()
+	return affinities[clientID].NodeID
+}
+
+func TestApplyAffinityBoundsLoad(t *testing.T) {
+	fleet := []Node{
+		{ID: "a", Latitude: 10, Longitude: 10, Status: "active"},
+		{ID: "b", Latitude: 10, Longitude: 10, Status: "active"},
+		{ID: "c", Latitude: 10, Longitude: 10, Status: "active"},
+	}
+	resetRegistry(t, fleet...)
+	ranked := []rankedNode{{Node: fleet[0]}, {Node: fleet[1]}, {Node: fleet[2]}}
+	for i := 0; i < 300; i++ {
+		client := "client-" + strconv.Itoa(i)
+		chosen, _ := applyAffinity(client, "haversine", 10, 10, nodeFilter{}, ranked)
+		pinAssignedClient(client, chosen[0].Node.ID)
+	}
+	bound := int(math.Ceil((1 + affinityLoadFactor) * 300 / 3))
+	for _, node := range fleet {
+		if pinnedClients[node.ID] > bound {
+			t.Fatalf("node %s holds %d pinned clients, over the bound of %d", node.ID, pinnedClients[node.ID], bound)
+		}
+	}
+}
+
+func TestRedirectPinsAssignedNode(t *testing.T) {
+	fleet := []Node{
+		{ID: "a", Latitude: 10, Longitude: 10, Status: "active", Capacity: 1},
+		{ID: "b", Latitude: 10, Longitude: 10.01, Status: "active", Capacity: 1},
+	}
+	resetRegistry(t, fleet...)
+	pinAssignedClient("client", "a")
+	if !tryAssign("someone-else", "", fleet[0]) {
+		t.Fatal("could not fill node a")
+	}
+
+	w := httptest.NewRecorder()
+	redirectClientHandler(w, httptest.NewRequest(http.MethodGet, "/redirect-client?lat=10&lon=10&client_id=client", nil))
+	var response struct {
+		Node     string `json:"nearest_node_id"`
+		Affinity string `json:"affinity"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("status %d: %v", w.Code, err)
+	}
+	if response.Node != "b" || response.Affinity != "assigned" {
+		t.Fatalf("sent to %s (%s), want b assigned since the pinned node is full", response.Node, response.Affinity)
+	}
+	if got := pinnedNode(t, "client"); got != "b" {
+		t.Fatalf("client pinned to %s, want the node it was sent to", got)
+	}
+}
+
+func TestTryAssignRespectsCapacity(t *testing.T) {
+	node := Node{ID: "n", Status: "active", Capacity: 10}
+	resetRegistry(t, node)
+
+	var wg sync.WaitGroup
+	var admitted sync.Map
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(client string) {
+			defer wg.Done()
+			if tryAssign(client, "", node) {
+				admitted.Store(client, true)
+			}
+		}("client-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	count := 0
+	admitted.Range(func(client, _ any) bool {
+		count++
+		if !tryAssign(client.(string), "", node) {
+			t.Errorf("assigned client %s no longer fits on its own node", client)
+		}
+		return true
+	})
+	if count != node.Capacity || clientCount[node.ID] != node.Capacity {
+		t.Fatalf("admitted %d clients with %d counted, want %d", count, clientCount[node.ID], node.Capacity)
+	}
+
+	admitted.Range(func(client, _ any) bool {
+		unassignClient(client.(string), node.ID)
+		return false
+	})
+	if !tryAssign("latecomer", "", node) {
+		t.Fatalf("place freed by unassignClient was not reused")
+	}
+}
+
+func TestAdmissionLimitsClientIDsPerAddress(t *testing.T) {
+	node := Node{ID: "n", Status: "active", Capacity: 100}
+	resetRegistry(t, node)
+
+	redirect := func(clientID, address string) (string, bool) {
+		r := httptest.NewRequest(http.MethodGet, "/redirect-client", nil)
+		r.RemoteAddr = address + ":40000"
+		key, source := admissionKey(clientID, r)
+		return key, tryAssign(key, source, node)
+	}
+
+	// An address rotating client IDs only gets its quota, then shares one place under its address
+	for i := 0; i < 3*clientIDsPerIP; i++ {
+		key, ok := redirect("rotating-"+strconv.Itoa(i), "198.51.100.7")
+		if !ok {
+			t.Fatalf("redirect %d refused", i)
+		}
+		want := "rotating-" + strconv.Itoa(i)
+		if i >= clientIDsPerIP {
+			want = "198.51.100.7"
+		}
+		if key != want {
+			t.Fatalf("redirect %d keyed as %q, want %q", i, key, want)
+		}
+	}
+	if clientCount[node.ID] != clientIDsPerIP+1 {
+		t.Fatalf("rotating IDs hold %d places, want %d", clientCount[node.ID], clientIDsPerIP+1)
+	}
+
+	// Clients that already hold a session keep their ID, and other addresses are unaffected
+	if key, _ := redirect("rotating-0", "198.51.100.7"); key != "rotating-0" {
+		t.Errorf("returning client keyed as %q, want its ID", key)
+	}
+	if key, ok := redirect("someone-else", "203.0.113.1"); key != "someone-else" || !ok {
+		t.Errorf("client from another address keyed as %q (admitted %v)", key, ok)
+	}
+
+	// Ending the sessions gives the address its quota back
+	clientMutex.Lock()
+	expireAssignments(time.Now().Add(2 * assignmentTTL))
+	sessions := len(clientAssignments) + len(sourceSessions)
+	clientMutex.Unlock()
+	if sessions != 0 {
+		t.Errorf("%d sessions or address counts left after every session expired", sessions)
+	}
+	if key, _ := redirect("fresh", "198.51.100.7"); key != "fresh" {
+		t.Errorf("address still limited after its sessions expired, keyed as %q", key)
+	}
+}
+
+func TestAssignmentsAreBounded(t *testing.T) {
+	node := Node{ID: "n", Status: "active"}
+	resetRegistry(t, node)
+	saved := maxAssignments
+	maxAssignments = 5
+	t.Cleanup(func() { maxAssignments = saved })
+
+	for i := 0; i < maxAssignments; i++ {
+		if !tryAssign("client-"+strconv.Itoa(i), "198.51.100."+strconv.Itoa(i), node) {
+			t.Fatalf("client %d refused below the limit", i)
+		}
+	}
+	if tryAssign("one-too-many", "198.51.100.99", node) {
+		t.Error("new session admitted past MAX_CLIENT_SESSIONS")
+	}
+	if !tryAssign("client-0", "198.51.100.0", node) {
+		t.Error("existing session refused at the limit")
+	}
+
+	// Expired sessions make room again
+	clientMutex.Lock()
+	for client, assignment := range clientAssignments {
+		assignment.Expires = time.Now().Add(-time.Second)
+		clientAssignments[client] = assignment
+	}
+	clientMutex.Unlock()
+	if !tryAssign("one-too-many", "198.51.100.99", node) {
+		t.Error("new session refused after the others expired")
+	}
+}
+
+func TestRequestIP(t *testing.T) {
+	trustedProxies = parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	defer func() { trustedProxies = parseTrustedProxies([]string{"127.0.0.1", "::1"}) }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer cannot forward", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "127.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "127.0.0.1:5000", []string{"198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"spoofed entries left of the client", "127.0.0.1:5000", []string{"192.0.2.9, 198.51.100.1"}, "198.51.100.1"},
+		{"repeated headers", "127.0.0.1:5000", []string{"192.0.2.9", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage entry stops the walk", "127.0.0.1:5000", []string{"198.51.100.1, nonsense"}, "127.0.0.1"},
+		{"only proxies", "127.0.0.1:5000", []string{"10.1.2.3"}, "10.1.2.3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/redirect-client", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := requestIP(r); got.String() != test.want {
+				t.Fatalf("requestIP = %v, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBreakerStateMachine(t *testing.T) {
+	failure := errors.New("connection refused")
+	tests := []struct {
+		name    string
+		steps   string // f = failure, s = success, w = cool-down passes and a request is routed to the node
+		want    string // "" while the breaker is closed
+		blocked bool   // Whether routing skips the node afterwards
+	}{
+		{"healthy node has no breaker", "sss", "", false},
+		{"failures below the threshold", strings.Repeat("f", breakerFailureThreshold-1), "closed", false},
+		{"success resets the failure count", strings.Repeat("f", breakerFailureThreshold-1) + "s" + strings.Repeat("f", breakerFailureThreshold-1), "closed", false},
+		{"threshold opens the breaker", strings.Repeat("f", breakerFailureThreshold), "open", true},
+		{"cool-down makes it half-open", strings.Repeat("f", breakerFailureThreshold) + "w", "half-open", true},
+		{"one trial failure reopens it", strings.Repeat("f", breakerFailureThreshold) + "wf", "open", true},
+		{"trial successes close it", strings.Repeat("f", breakerFailureThreshold) + strings.Repeat("ws", breakerTrialSuccesses), "", false},
+		{"too few trial successes", strings.Repeat("f", breakerFailureThreshold) + strings.Repeat("ws", breakerTrialSuccesses-1), "half-open", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetRegistry(t)
+			for _, step := range test.steps {
+				switch step {
+				case 'f':
+					recordOutcome("n", "proxy", failure)
+				case 's':
+					recordOutcome("n", "proxy", nil)
+				case 'w':
+					if !claimBreakerTrial("n", time.Now().Add(breakerCooldown+time.Second)) {
+						t.Fatalf("breaker still open after the cool-down")
+					}
+				}
+			}
+			state := ""
+			if breaker := breakerState("n"); breaker != nil {
+				state = breaker.State
+			}
+			if state != test.want {
+				t.Fatalf("breaker state = %q, want %q", state, test.want)
+			}
+			if open := breakerOpen("n", time.Now()); open != test.blocked {
+				t.Fatalf("breakerOpen = %v in state %q", open, state)
+			}
+		})
+	}
+}
+
+func TestBreakerTrialPermits(t *testing.T) {
+	resetRegistry(t)
+	saved := breakerTrialSuccesses
+	breakerTrialSuccesses = 100 // Keep the breaker half-open throughout
+	t.Cleanup(func() { breakerTrialSuccesses = saved })
+	for i := 0; i < breakerFailureThreshold; i++ {
+		recordOutcome("n", "proxy", errors.New("connection refused"))
+	}
+	cooled := time.Now().Add(breakerCooldown + time.Second)
+
+	// Checking the breaker while ranking does not change it
+	if breakerOpen("n", cooled) || breakerOpen("n", cooled) {
+		t.Fatal("cooled-down node still kept out of routing")
+	}
+	if state := breakerState("n").State; state != "open" {
+		t.Fatalf("checking the breaker moved it to %s", state)
+	}
+
+	for i := 0; i < breakerTrialRequests; i++ {
+		if !claimBreakerTrial("n", cooled) {
+			t.Fatalf("trial %d refused", i+1)
+		}
+	}
+	if state := breakerState("n").State; state != "half-open" {
+		t.Fatalf("breaker %s after the first trial, want half-open", state)
+	}
+	if claimBreakerTrial("n", cooled) || !breakerOpen("n", cooled) {
+		t.Fatal("more trials routed than BREAKER_TRIAL_REQUESTS")
+	}
+
+	// Probes do not free a permit, a routed request reporting back does
+	recordOutcome("n", "probe", nil)
+	if claimBreakerTrial("n", cooled) {
+		t.Fatal("probe freed a trial permit")
+	}
+	releaseBreakerTrial("n")
+	if !claimBreakerTrial("n", cooled) {
+		t.Fatal("released permit not handed out again")
+	}
+	recordOutcome("n", "notify", nil)
+	if !claimBreakerTrial("n", cooled) {
+		t.Fatal("permit not freed by the trial's outcome")
+	}
+
+	// Permits of trials that never report back lapse
+	if !claimBreakerTrial("n", cooled.Add(breakerCooldown)) || breakerState("n").State != "half-open" {
+		t.Fatal("lost trial permits never lapsed")
+	}
+}
+
+func TestNotificationOutcome(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		failed bool
+	}{
+		{"delivered", http.StatusOK, false},
+		{"node full", http.StatusServiceUnavailable, false},
+		{"missing endpoint", http.StatusNotFound, true},
+		{"server error", http.StatusInternalServerError, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetRegistry(t)
+			var path string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			sendMessageToNode(Node{ID: "n", IPAddress: server.URL}, "Client redirected to your server")
+			if path != "/receive" {
+				t.Fatalf("notification went to %q, want /receive", path)
+			}
+			breaker := breakerState("n")
+			if failed := breaker != nil && breaker.ConsecutiveFailures > 0; failed != test.failed {
+				t.Fatalf("recorded failure = %v, want %v", failed, test.failed)
+			}
+		})
+	}
+}
+
+func TestSimulationLeavesLiveStateAlone(t *testing.T) {
+	resetRegistry(t,
+		Node{ID: "a", Latitude: 10, Longitude: 10, Status: "active", Capabilities: defaultCapabilities},
+		Node{ID: "b", Latitude: 10, Longitude: 11, Status: "active", Capabilities: defaultCapabilities},
+		Node{ID: "c", Latitude: 11, Longitude: 10, Status: "active", Capabilities: defaultCapabilities},
+	)
+	// Breaker of a that cooled down long ago: routing would move it to half-open, a simulation must not
+	openedAt := time.Now().Add(-2 * breakerCooldown)
+	breakers["a"] = &CircuitBreaker{State: "open", ConsecutiveFailures: breakerFailureThreshold, OpenedAt: &openedAt}
+	roundRobin := routingStrategies["round-robin"].(*roundRobinStrategy)
+	before := roundRobin.next.Load()
+
+	for _, strategy := range []string{"weighted", "round-robin"} {
+		result, err := runSimulation(simulationRequest{Strategy: strategy, Clients: []simulatedClient{{Lat: 10, Lon: 10, Weight: 3}, {Lat: 10.5, Lon: 10.5}}})
+		if err != nil {
+			t.Fatalf("%s simulation failed: %v", strategy, err)
+		}
+		if served := result["baseline"].(simulationSummary).Clients - result["baseline"].(simulationSummary).Unserved; served != 4 {
+			t.Fatalf("%s simulation served %v clients, want 4", strategy, served)
+		}
+	}
+
+	if breaker := breakerState("a"); breaker == nil || breaker.State != "open" {
+		t.Fatalf("simulation changed the live breaker to %+v", breaker)
+	}
+	if after := roundRobin.next.Load(); after != before {
+		t.Fatalf("simulation advanced the live round-robin rotation from %d to %d", before, after)
+	}
+}
+
+func TestSimulationRoundRobinIsRepeatable(t *testing.T) {
+	resetRegistry(t,
+		Node{ID: "a", Latitude: 10, Longitude: 10, Status: "active", Capabilities: defaultCapabilities},
+		Node{ID: "b", Latitude: 10, Longitude: 11, Status: "active", Capabilities: defaultCapabilities},
+	)
+	request := simulationRequest{Strategy: "round-robin", Synthetic: &syntheticClients{Count: 7, Seed: 1}}
+	first, err := runSimulation(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routingStrategies["round-robin"].Rank(routingRequest{Lat: 10, Lon: 10, Count: 1, Now: time.Now(), Fleet: liveFleet()})
+	second, err := runSimulation(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fleet := range []string{"baseline", "scenario"} {
+		if a, b := first[fleet].(simulationSummary).PerNode, second[fleet].(simulationSummary).PerNode; a[0] != b[0] {
+			t.Fatalf("%s differs between runs: %+v then %+v", fleet, a, b)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	defer func(key string) { adminKey = key }(adminKey)
+	handler := withAdminAuth(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name          string
+		key           string
+		authorization string
+		want          int
+	}{
+		{"disabled without ADMIN_KEY", "", "Bearer anything", http.StatusForbidden},
+		{"missing token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"wrong scheme", "secret", "Basic secret", http.StatusUnauthorized},
+		{"valid token", "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			adminKey = test.key
+			r := httptest.NewRequest(http.MethodPost, "/simulate", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.want {
+				t.Fatalf("status = %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestReferenceDistances(t *testing.T) {
+	tests := []struct {
+		name                   string
+		model                  func(lat1, lon1, lat2, lon2 float64) float64
+		lat1, lon1, lat2, lon2 float64
+		km                     float64
+	}{
+		// Vincenty's own test line, and lengths of the WGS-84 equator and meridian
+		{"vincenty Flinders Peak-Buninyong", vincentyDistance, -37.95103342, 144.42486789, -37.65282114, 143.92649554, 54.972271},
+		{"vincenty 1 degree along the equator", vincentyDistance, 0, 0, 0, 1, 111.319491},
+		{"vincenty pole to pole", vincentyDistance, 90, 0, -90, 0, 20003.931459},
+		{"vincenty across the antimeridian", vincentyDistance, 0, 179.5, 0, -179.5, 111.319491},
+		{"vincenty same point", vincentyDistance, 51.5, -0.1, 51.5, -0.1, 0},
+		{"haversine 1 degree along the equator", haversineDistance, 0, 0, 0, 1, 111.194927},
+		{"haversine antipodes", haversineDistance, 10, 20, -10, -160, 6371 * math.Pi},
+		{"haversine across the antimeridian", haversineDistance, 0, 179.5, 0, -179.5, 111.194927},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Both models are accurate to about a millimetre against these values
+			if km := test.model(test.lat1, test.lon1, test.lat2, test.lon2); math.Abs(km-test.km) > 1e-6 {
+				t.Fatalf("got %.7f km, want %.7f km", km, test.km)
+			}
+		})
+	}
+}
+
+// Random point biased towards the awkward places: the poles and the antimeridian
+func awkwardPoint(random *mathrand.Rand) (float64, float64) {
+	lat, lon := math.Asin(2*random.Float64()-1)*180/math.Pi, random.Float64()*360-180
+	switch random.Intn(4) {
+	case 0:
+		lat = math.Copysign(90-random.Float64(), lat) // Within a degree of a pole
+	case 1:
+		lon = math.Copysign(180-random.Float64(), lon) // Within a degree of the antimeridian
+	case 2:
+		if random.Intn(2) == 0 {
+			lat = math.Copysign(90, lat) // On a pole
+		} else {
+			lon = math.Copysign(180, lon) // On the antimeridian
+		}
+	}
+	return lat, lon
+}
+
+// Point on the other side of the globe
+func antipode(lat, lon float64) (float64, float64) {
+	lon += 180
+	if lon > 180 {
+		lon -= 360
+	}
+	return -lat, lon
+}
+
+func TestDistanceModelProperties(t *testing.T) {
+	cases := 20000
+	if testing.Short() {
+		cases = 1000
+	}
+	models := []struct {
+		name        string
+		distance    func(lat1, lon1, lat2, lon2 float64) float64
+		antipodalKm float64
+	}{
+		{"haversine", haversineDistance, 6371 * math.Pi},
+		{"vincenty", vincentyDistance, rectifyingRadius * math.Pi},
+	}
+	wrap := func(lon float64) float64 {
+		if lon > 0 {
+			return lon - 360
+		}
+		return lon + 360
+	}
+
+	random := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < cases; i++ {
+		lat1, lon1 := awkwardPoint(random)
+		lat2, lon2 := awkwardPoint(random)
+		if random.Intn(4) == 0 {
+			// Nearly antipodal pair
+			lat2, lon2 = antipode(lat1, lon1)
+			lat2 = max(-90, min(90, lat2+random.NormFloat64()*1e-3))
+		}
+		lat3, lon3 := awkwardPoint(random)
+		where := fmt.Sprintf("(%v,%v) (%v,%v) (%v,%v)", lat1, lon1, lat2, lon2, lat3, lon3)
+
+		for _, model := range models {
+			// Next to antipodal points one of two equivalent inputs may converge while the other takes
+			// the fallback, so results that should match may differ by a few metres
+			const matchKm = 0.01
+			d := model.distance
+			ab, ba := d(lat1, lon1, lat2, lon2), d(lat2, lon2, lat1, lon1)
+			if d(lat1, lon1, lat1, lon1) > 1e-9 {
+				t.Fatalf("%s identity: %s", model.name, where)
+			}
+			if math.Abs(ab-ba) > matchKm {
+				t.Fatalf("%s symmetry: %s: %v vs %v", model.name, where, ab, ba)
+			}
+			if math.IsNaN(ab) || ab < 0 || ab > model.antipodalKm+1e-6 {
+				t.Fatalf("%s range: %s: %v", model.name, where, ab)
+			}
+			if math.Abs(d(lat1, wrap(lon1), lat2, lon2)-ab) > matchKm {
+				t.Fatalf("%s longitude wrap: %s", model.name, where)
+			}
+			if math.Abs(lat1) == 90 && math.Abs(d(lat1, random.Float64()*360-180, lat2, lon2)-ab) > matchKm {
+				t.Fatalf("%s pole longitude: %s", model.name, where)
+			}
+			// The fallback for nearly antipodal points is within a few kilometres, so allow for it
+			if ac, bc := d(lat1, lon1, lat3, lon3), d(lat2, lon2, lat3, lon3); ab > ac+bc+5e-4*model.antipodalKm {
+				t.Fatalf("%s triangle inequality: %s: %v > %v + %v", model.name, where, ab, ac, bc)
+			}
+			if alat, alon := antipode(lat1, lon1); math.Abs(d(lat1, lon1, alat, alon)-model.antipodalKm) > 1 {
+				t.Fatalf("%s antipodes: %s", model.name, where)
+			}
+		}
+
+		// The ellipsoid never comes out shorter than ellipsoidMinRatio of the sphere, which the index relies on
+		spherical, ellipsoidal := haversineDistance(lat1, lon1, lat2, lon2), vincentyDistance(lat1, lon1, lat2, lon2)
+		if ellipsoidal < ellipsoidMinRatio*spherical || ellipsoidal > 1.006*spherical+1e-6 {
+			t.Fatalf("models disagree: %s: %v vs %v", where, spherical, ellipsoidal)
+		}
+	}
+}
+
+func TestValidateCoordinates(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+		valid    bool
+	}{
+		{0, 0, true},
+		{90, 180, true},
+		{-90, -180, true},
+		{90.001, 0, false},
+		{-90.001, 0, false},
+		{0, 180.001, false},
+		{0, -180.001, false},
+		{math.NaN(), 0, false},
+		{0, math.NaN(), false},
+		{999, 0, false},
+	}
+	for _, test := range tests {
+		if err := validateCoordinates(test.lat, test.lon); (err == nil) != test.valid {
+			t.Errorf("validateCoordinates(%v, %v) = %v, want valid %v", test.lat, test.lon, err, test.valid)
+		}
+	}
+}
+
+func TestIndexMatchesVincentyScan(t *testing.T) {
+	random := mathrand.New(mathrand.NewSource(3))
+	accept := func(string) bool { return true }
+	mismatches := 0
+	for i := 0; i < 300; i++ {
+		// Near the equator a node due north is nearer on the ellipsoid than one slightly closer due east
+		// on the sphere, so each fleet gets such a pair among nodes scattered around the client
+		lat, lon := random.NormFloat64()*5, random.Float64()*360-180
+		fleet := make(map[string]Node)
+		index := newSpatialIndex()
+		add := func(id string, nodeLat, nodeLon float64) {
+			fleet[id] = Node{ID: id, Latitude: nodeLat, Longitude: nodeLon, Status: "active"}
+			index.put(id, nodeLat, nodeLon)
+		}
+		step := 0.2 + random.Float64()*0.3
+		add("north", lat+step, lon)
+		add("east", lat, lon+step*0.997/math.Cos(lat*math.Pi/180))
+		for j := 0; j < 200; j++ {
+			add(strconv.Itoa(j), lat+random.NormFloat64()*3, lon+random.NormFloat64()*3)
+		}
+
+		request := routingRequest{Lat: lat, Lon: lon, Fleet: fleetView{Nodes: fleet, Index: index}, Model: "vincenty"}
+		distances := make(map[string]float64, len(fleet))
+		want := make([]string, 0, len(fleet))
+		for id, node := range fleet {
+			distances[id] = request.distance(node)
+			want = append(want, id)
+		}
+		sort.Slice(want, func(a, b int) bool { return distances[want[a]] < distances[want[b]] })
+
+		found := request.nearest(5, accept)
+		if len(found) != 5 {
+			t.Fatalf("got %d nodes for (%v,%v), want 5", len(found), lat, lon)
+		}
+		for k, id := range found {
+			if distances[id] != distances[want[k]] {
+				t.Fatalf("result %d for (%v,%v) is %s at %.6f km, want %s at %.6f km", k, lat, lon, id, distances[id], want[k], distances[want[k]])
+			}
+		}
+		if spherical := index.nearest(lat, lon, 1, accept); spherical[0] != found[0] {
+			mismatches++
+		}
+	}
+	if mismatches == 0 {
+		t.Fatalf("the sphere and the ellipsoid agreed on every query, so re-ranking was not exercised")
+	}
+}
+
+// Point the registry persistence at a scratch folder with a fresh journal
+func useScratchRegistry(t *testing.T, every int) {
+	t.Helper()
+	mutex.Lock()
+	savedFolder, savedEvery := registryFolder, snapshotEvery
+	registryFolder, snapshotEvery = t.TempDir(), every
+	registrySeq = 0
+	err := writeSnapshot()
+	mutex.Unlock()
+	t.Cleanup(func() {
+		mutex.Lock()
+		if journalFile != nil {
+			journalFile.Close()
+			journalFile = nil
+		}
+		registryFolder, snapshotEvery = savedFolder, savedEvery
+		registrySeq = 0
+		mutex.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	// Steps: "put ID LATITUDE", "delete ID", "heartbeat ID", "snapshot", "torn" for a half-written entry,
+	// or "stale SEQ ID LATITUDE" for a put the snapshot already holds, left by a crash before truncation
+	tests := []struct {
+		name     string
+		every    int
+		steps    []string
+		nodes    map[string]float64 // Restored node IDs with their latitude
+		replayed int
+		seq      uint64
+	}{
+		{"empty", 0, nil, map[string]float64{}, 0, 0},
+		{"puts", 0, []string{"put a 1", "put b 2"}, map[string]float64{"a": 1, "b": 2}, 2, 2},
+		{"later put wins", 0, []string{"put a 1", "put a 5"}, map[string]float64{"a": 5}, 2, 2},
+		{"delete", 0, []string{"put a 1", "put b 2", "delete a"}, map[string]float64{"b": 2}, 3, 3},
+		{"delete of unknown node", 0, []string{"delete x", "put a 1"}, map[string]float64{"a": 1}, 2, 2},
+		{"heartbeats are not journaled", 0, []string{"put a 1", "heartbeat a", "put b 2"}, map[string]float64{"a": 1, "b": 2}, 2, 3},
+		{"journal on top of snapshot", 0, []string{"put a 1", "put b 2", "snapshot", "delete b", "put c 3"}, map[string]float64{"a": 1, "c": 3}, 2, 4},
+		{"snapshot only", 0, []string{"put a 1", "snapshot"}, map[string]float64{"a": 1}, 0, 1},
+		{"automatic snapshots", 2, []string{"put a 1", "put b 2", "put c 3", "delete a", "put d 4"}, map[string]float64{"b": 2, "c": 3, "d": 4}, 1, 5},
+		{"torn final entry", 0, []string{"put a 1", "put b 2", "torn"}, map[string]float64{"a": 1, "b": 2}, 2, 2},
+		{"torn entry mid-journal", 0, []string{"put a 1", "torn", "put b 2"}, map[string]float64{"a": 1, "b": 2}, 2, 2},
+		{"entries in the snapshot are skipped", 0, []string{"put a 1", "put a 5", "snapshot", "stale 1 a 1", "stale 2 a 5"}, map[string]float64{"a": 5}, 0, 2},
+		{"untruncated journal", 0, []string{"put a 1", "delete a", "snapshot", "stale 1 a 1", "put b 2"}, map[string]float64{"b": 2}, 1, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetRegistry(t)
+			useScratchRegistry(t, test.every)
+			mutex.Lock()
+			for _, step := range test.steps {
+				fields := strings.Fields(step)
+				switch fields[0] {
+				case "put":
+					latitude, _ := strconv.ParseFloat(fields[2], 64)
+					node := Node{ID: fields[1], IPAddress: "127.0.0.1", Port: "9000", Latitude: latitude}
+					putNode(node)
+					journalPut(node)
+				case "delete":
+					removeNode(fields[1])
+					journalDelete(fields[1])
+				case "heartbeat":
+					journalHeartbeat(nodes[fields[1]])
+				case "snapshot":
+					if err := writeSnapshot(); err != nil {
+						t.Error(err)
+					}
+				case "torn":
+					journalFile.Write([]byte(`{"seq": 99, "op": "put", "node": {"id": "torn"` + "\n"))
+				case "stale":
+					seq, _ := strconv.ParseUint(fields[1], 10, 64)
+					latitude, _ := strconv.ParseFloat(fields[3], 64)
+					line, _ := json.Marshal(registryRecord{Seq: seq, Op: "put", Node: &Node{ID: fields[2], IPAddress: "127.0.0.1", Port: "9000", Latitude: latitude}})
+					journalFile.Write(append(line, '\n'))
+				}
+			}
+			journalFile.Close()
+			journalFile = nil
+			mutex.Unlock()
+
+			// Come back up with an empty registry and rebuild it from disk
+			resetRegistry(t)
+			mutex.Lock()
+			defer mutex.Unlock()
+			registrySeq = 0
+			replayed, err := readRegistry()
+			if err != nil {
+				t.Error(err)
+			}
+			if replayed != test.replayed {
+				t.Errorf("replayed %d entries, want %d", replayed, test.replayed)
+			}
+			if registrySeq != test.seq {
+				t.Errorf("sequence %d, want %d", registrySeq, test.seq)
+			}
+			got := make(map[string]float64, len(nodes))
+			for id, node := range nodes {
+				got[id] = node.Latitude
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.nodes) {
+				t.Errorf("restored %v, want %v", got, test.nodes)
+			}
+			if nearest := nodeIndex.nearest(0, 0, len(test.nodes)+1, func(string) bool { return true }); len(nearest) != len(test.nodes) {
+				t.Errorf("index holds %d nodes, want %d", len(nearest), len(test.nodes))
+			}
+		})
+	}
+}
+
+func TestLoadRegistry(t *testing.T) {
+	resetRegistry(t)
+	useScratchRegistry(t, 0)
+	start := time.Now().Add(-time.Hour)
+	mutex.Lock()
+	for _, node := range []Node{
+		{ID: "old", IPAddress: "10.0.0.1", Port: "9000", RegisteredAt: start, Verified: true, Status: "active"},
+		{ID: "new", IPAddress: "10.0.0.1", Port: "9000", RegisteredAt: start.Add(time.Minute), Verified: true, Status: "active"},
+		{ID: "other", IPAddress: "10.0.0.2", Port: "9000", RegisteredAt: start, Verified: true, Status: "active"},
+	} {
+		journalPut(node)
+	}
+	journalFile.Close()
+	journalFile = nil
+	mutex.Unlock()
+
+	resetRegistry(t)
+	if err := loadRegistry(); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := nodes["old"]; ok || len(nodes) != 2 {
+		t.Fatalf("restored %d nodes including the older entry on a shared endpoint", len(nodes))
+	}
+	for id, node := range nodes {
+		if node.Verified || node.Status != "unverified" {
+			t.Errorf("%s restored as %q (verified %v), want unverified", id, node.Status, node.Verified)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(registryFolder, journalFileName)); err != nil || info.Size() != 0 {
+		t.Errorf("journal not compacted into the snapshot after loading: %v", err)
+	}
+}
+
+func TestUpdateStatusJournalsEveryChange(t *testing.T) {
+	now := time.Now()
+	down := now.Add(-time.Duration(downAfterMisses+1) * heartbeatInterval)
+	tests := []struct {
+		name      string
+		stored    Node
+		change    func(node *Node)
+		journaled bool
+	}{
+		{"nothing changed", Node{Verified: true, LastHeartbeat: now}, func(node *Node) {}, false},
+		{"lease renewed", Node{Verified: true, LastHeartbeat: now}, func(node *Node) { node.LastHeartbeat = now.Add(time.Second) }, false},
+		{"load reported", Node{Verified: true, LastHeartbeat: now}, func(node *Node) { node.Load = &NodeLoad{CPUPercent: 50} }, false},
+		{"status changed", Node{Verified: true, LastHeartbeat: down}, func(node *Node) { node.LastHeartbeat = now }, true},
+		{"down node drained", Node{Verified: true, LastHeartbeat: down}, func(node *Node) { node.Draining = true }, true},
+		{"unverified node verified while down", Node{LastHeartbeat: down}, func(node *Node) { node.Verified = true }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored := test.stored
+			stored.ID, stored.IPAddress, stored.Port = "n", "10.0.0.1", "9000"
+			stored.Status = deriveStatus(stored, now)
+			resetRegistry(t, stored)
+			useScratchRegistry(t, 0)
+
+			mutex.Lock()
+			before := registrySeq
+			node := nodes["n"]
+			test.change(&node)
+			node = updateStatus(node, now)
+			journaled := registrySeq != before
+			journalFile.Close()
+			journalFile = nil
+			mutex.Unlock()
+			if journaled != test.journaled {
+				t.Fatalf("journaled %v, want %v", journaled, test.journaled)
+			}
+
+			// What a restart or a backup sees matches the live entry
+			resetRegistry(t)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if _, err := readRegistry(); err != nil {
+				t.Fatal(err)
+			}
+			restored := nodes["n"]
+			if test.journaled && (restored.Draining != node.Draining || restored.Verified != node.Verified || restored.Status != node.Status) {
+				t.Errorf("restored draining %v, verified %v, status %q; live entry has %v, %v, %q",
+					restored.Draining, restored.Verified, restored.Status, node.Draining, node.Verified, node.Status)
+			}
+		})
+	}
+}
+
+// A node control call signed the way nodes sign them
+func signedNodeRequest(method, uri, keyID string, secret []byte, body string, signedAt time.Time) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, uri, timestamp)
+	mac.Write([]byte(body))
+	r.Header.Set("X-Node-Key-Id", keyID)
+	r.Header.Set("X-Node-Timestamp", timestamp)
+	r.Header.Set("X-Node-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+// Accept node control calls signed with the given keys only, with a fresh replay cache
+func useNodeKeys(t *testing.T, keys map[string][]byte) {
+	t.Helper()
+	savedKeys, savedAllow := nodeKeys, allowUnauthenticated
+	nodeKeys, allowUnauthenticated = keys, false
+	signaturesMutex.Lock()
+	seenSignatures = make(map[string]time.Time)
+	signaturesMutex.Unlock()
+	t.Cleanup(func() { nodeKeys, allowUnauthenticated = savedKeys, savedAllow })
+}
+
+// Handler answering with the identity the call was authenticated as
+func echoIdentity(w http.ResponseWriter, r *http.Request) {
+	identity := requestIdentity(r)
+	fmt.Fprintf(w, "%s %s", identity.NodeID, identity.KeyID)
+}
+
+func TestNodeSignature(t *testing.T) {
+	secret := []byte("node secret")
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    int
+	}{
+		{"signed", func() *http.Request {
+			return signedNodeRequest(http.MethodPost, "/heartbeat", "k1", secret, `{"id":"n"}`, time.Now())
+		}, http.StatusOK},
+		{"unsigned", func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(`{"id":"n"}`))
+		}, http.StatusUnauthorized},
+		{"unknown key", func() *http.Request {
+			return signedNodeRequest(http.MethodPost, "/heartbeat", "k2", secret, `{"id":"n"}`, time.Now())
+		}, http.StatusUnauthorized},
+		{"wrong secret", func() *http.Request {
+			return signedNodeRequest(http.MethodPost, "/heartbeat", "k1", []byte("guess"), `{"id":"n"}`, time.Now())
+		}, http.StatusUnauthorized},
+		{"tampered body", func() *http.Request {
+			r := signedNodeRequest(http.MethodPost, "/heartbeat", "k1", secret, `{"id":"n"}`, time.Now())
+			r.Body = io.NopCloser(strings.NewReader(`{"id":"m"}`))
+			return r
+		}, http.StatusUnauthorized},
+		{"other path", func() *http.Request {
+			r := signedNodeRequest(http.MethodPost, "/heartbeat", "k1", secret, `{"id":"n"}`, time.Now())
+			r.URL.Path, r.RequestURI = "/deregister-node", "/deregister-node"
+			return r
+		}, http.StatusUnauthorized},
+		{"stale", func() *http.Request {
+			return signedNodeRequest(http.MethodPost, "/heartbeat", "k1", secret, `{"id":"n"}`, time.Now().Add(-2*maxSignatureClockSkew))
+		}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useNodeKeys(t, map[string][]byte{"k1": secret})
+			w := httptest.NewRecorder()
+			withNodeAuth(echoIdentity)(w, test.request())
+			if w.Code != test.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+			if w.Code == http.StatusOK && w.Body.String() != " k1" {
+				t.Fatalf("authenticated as %q, want key k1", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("replayed", func(t *testing.T) {
+		useNodeKeys(t, map[string][]byte{"k1": secret})
+		original := signedNodeRequest(http.MethodPost, "/heartbeat", "k1", secret, `{"id":"n"}`, time.Now())
+		replay := original.Clone(original.Context())
+		replay.Body = io.NopCloser(strings.NewReader(`{"id":"n"}`))
+		for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+			w := httptest.NewRecorder()
+			withNodeAuth(echoIdentity)(w, []*http.Request{original, replay}[i])
+			if w.Code != want {
+				t.Fatalf("call %d: status %d, want %d", i+1, w.Code, want)
+			}
+		}
+	})
+}
+
+// Client certificate for a node issued by the given CA
+func nodeCertificate(t *testing.T, ca *x509.Certificate, caSigner crypto.Signer, nodeID, keyID string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: nodeID, OrganizationalUnit: []string{keyID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNodeCertificates(t *testing.T) {
+	useNodeKeys(t, map[string][]byte{"k1": []byte("node secret")})
+	savedFolder, savedRequired := registryFolder, mtlsRequired
+	savedCA, savedKey, savedPEM := caCertificate, caKey, caPEM
+	registryFolder, mtlsRequired = t.TempDir(), true
+	t.Cleanup(func() {
+		registryFolder, mtlsRequired = savedFolder, savedRequired
+		caCertificate, caKey, caPEM = savedCA, savedKey, savedPEM
+	})
+
+	// A foreign CA: same name as ours, different key
+	if err := loadOrCreateCA(); err != nil {
+		t.Fatal(err)
+	}
+	foreignCA, foreignKey := caCertificate, caKey
+	registryFolder = t.TempDir()
+	if err := loadOrCreateCA(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mTLS listener as serveMTLS sets it up
+	serverCertificate, err := issueServerCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCertificate)
+	server := httptest.NewUnstartedServer(withNodeAuth(withRequiredCertificate(echoIdentity)))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(caCertificate)
+
+	tests := []struct {
+		name        string
+		certificate []tls.Certificate
+		want        string // Authenticated identity, or "" when the call must be refused
+	}{
+		{"issued certificate", []tls.Certificate{nodeCertificate(t, caCertificate, caKey, "node-1", "k1")}, "node-1 k1"},
+		{"revoked key", []tls.Certificate{nodeCertificate(t, caCertificate, caKey, "node-2", "k-revoked")}, ""},
+		{"foreign CA", []tls.Certificate{nodeCertificate(t, foreignCA, foreignKey, "node-1", "k1")}, ""},
+		{"no certificate", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: test.certificate}}}
+			defer client.CloseIdleConnections()
+			resp, err := client.Post(server.URL+"/heartbeat", "application/json", strings.NewReader(`{"id":"node-1"}`))
+			if err != nil {
+				if test.want != "" {
+					t.Fatal(err)
+				}
+				return // Refused during the handshake
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if test.want == "" && resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("status %d, want the call refused: %s", resp.StatusCode, body)
+			}
+			if test.want != "" && (resp.StatusCode != http.StatusOK || string(body) != test.want) {
+				t.Fatalf("status %d as %q, want %q", resp.StatusCode, body, test.want)
+			}
+		})
+	}
+}
+
+// Run as one of several main servers, restoring the single-server setup afterwards
+func useReplicas(t *testing.T, self string, urls ...string) {
+	t.Helper()
+	savedURLs, savedSelf, savedKey := peerURLs, selfURL, replicationKey
+	peerURLs, selfURL, replicationKey = urls, self, []byte("replication key")
+	replicationMutex.Lock()
+	savedPeers, savedPrimary, savedTerm, savedTermPrimary := peers, currentPrimary, replicationTerm, termPrimary
+	peers = make(map[string]*peerState)
+	replicationMutex.Unlock()
+	t.Cleanup(func() {
+		peerURLs, selfURL, replicationKey = savedURLs, savedSelf, savedKey
+		replicationMutex.Lock()
+		peers, currentPrimary, replicationTerm, termPrimary = savedPeers, savedPrimary, savedTerm, savedTermPrimary
+		replicationMutex.Unlock()
+	})
+}
+
+// Set the term, its leader and the primary this server follows
+func setPrimary(term uint64, leader, primary string) {
+	replicationMutex.Lock()
+	replicationTerm, termPrimary, currentPrimary = term, leader, primary
+	replicationMutex.Unlock()
+}
+
+func TestBackupForwardsToPrimary(t *testing.T) {
+	secret := []byte("node secret")
+	useNodeKeys(t, map[string][]byte{"k1": secret})
+	var forwarded *http.Request
+	var forwardedBody []byte
+	primary := httptest.NewServer(withNodeAuth(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		forwardedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		echoIdentity(w, r)
+	}))
+	defer primary.Close()
+	useReplicas(t, "http://backup.invalid", primary.URL, "http://backup.invalid")
+	setPrimary(1, primary.URL, primary.URL)
+
+	handled := false
+	w := httptest.NewRecorder()
+	r := signedNodeRequest(http.MethodPost, "/register-node", "k1", secret, `{"id":"n"}`, time.Now())
+	r.Header.Set("X-Forwarded-Node-Identity", "forged k1") // Only the backup may vouch for an identity
+	withPrimaryForwarding(withNodeAuth(func(w http.ResponseWriter, r *http.Request) { handled = true }))(w, r)
+
+	if handled {
+		t.Fatal("backup applied the registration itself")
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != " k1" {
+		t.Fatalf("status %d as %q, want the primary's answer for key k1", w.Code, w.Body.String())
+	}
+	if forwarded == nil || string(forwardedBody) != `{"id":"n"}` || !fromPeer(forwarded) {
+		t.Fatalf("primary got %q without the backup's signature", forwardedBody)
+	}
+	if forwarded.Header.Get("X-Forwarded-Node-Identity") != "" {
+		t.Fatal("the client's forged identity header was passed on")
+	}
+
+	// A call that claims to come from a backup is not believed without the peer signature
+	mtlsRequired = true
+	defer func() { mtlsRequired = false }()
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/register-node", strings.NewReader(`{"id":"n"}`))
+	r.Header.Set("X-Forwarded-Node-Identity", "n k1")
+	withNodeAuth(withRequiredCertificate(echoIdentity))(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unsigned forwarded identity accepted with status %d", w.Code)
+	}
+}
+
+func TestStaleTermPrimaryStepsDown(t *testing.T) {
+	resetRegistry(t)
+	useReplicas(t, "http://a.invalid", "http://a.invalid", "http://b.invalid", "http://c.invalid")
+
+	// b leads term 3, so an append from a in term 2 is refused with b's term
+	setPrimary(3, "http://b.invalid", "http://b.invalid")
+	body, _ := json.Marshal(map[string]interface{}{"term": 2, "primary": "http://a.invalid", "records": []registryRecord{{Seq: 1, Op: "put", Node: &Node{ID: "n"}}}})
+	w := httptest.NewRecorder()
+	replicaAppendHandler(w, httptest.NewRequest(http.MethodPost, "/replica/append", bytes.NewReader(body)))
+	var reply replicationReply
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusConflict || reply.Term != 3 || reply.Primary != "http://b.invalid" {
+		t.Fatalf("stale append answered %d with term %d led by %s", w.Code, reply.Term, reply.Primary)
+	}
+	mutex.RLock()
+	_, applied := nodes["n"]
+	mutex.RUnlock()
+	if applied {
+		t.Fatal("records from the stale primary were applied")
+	}
+
+	// a, still primary of term 2, steps down on that answer and follows b
+	setPrimary(2, "http://a.invalid", "http://a.invalid")
+	stepDown(reply)
+	if isPrimary() {
+		t.Fatal("stale primary kept the primary role")
+	}
+	replicationMutex.Lock()
+	term, primary := replicationTerm, currentPrimary
+	replicationMutex.Unlock()
+	if term != 3 || primary != "http://b.invalid" {
+		t.Fatalf("following %s in term %d, want b in term 3", primary, term)
+	}
+}
+
+func TestReportRTT(t *testing.T) {
+	resetRegistry(t, Node{ID: "london", IPAddress: "10.0.0.1", Port: "9000", Latitude: 51.51, Longitude: -0.13, Status: "active"})
+	rttMutex.Lock()
+	rttEstimates = make(map[rttCell]map[string]*LatencyEstimate)
+	rttMutex.Unlock()
+	rttReportLimits = &rateWindow{}
+
+	report := func(source string, lat, lon, rtt float64) int {
+		body := fmt.Sprintf(`{"node_id": "london", "lat": %v, "lon": %v, "rtt_ms": %v}`, lat, lon, rtt)
+		r := httptest.NewRequest(http.MethodPost, "/report-rtt", strings.NewReader(body))
+		r.RemoteAddr = source + ":40000"
+		w := httptest.NewRecorder()
+		reportRTTHandler(w, r)
+		return w.Code
+	}
+	usable := func() (float64, bool) {
+		rtt, ok := measuredLatencies(51.5, -0.1, time.Now())["london"]
+		return rtt, ok
+	}
+
+	// Paris is about 340 km away, so anything under 3.4 ms is faster than light in fibre
+	if code := report("198.51.100.1", 48.86, 2.35, 1); code != http.StatusBadRequest {
+		t.Errorf("impossible RTT answered %d, want 400", code)
+	}
+
+	// One address alone never makes an estimate usable, however often it reports
+	for i := 0; i < 5; i++ {
+		report("198.51.100.1", 51.5, -0.1, 20)
+	}
+	if _, ok := usable(); ok {
+		t.Fatal("estimate usable with a single reporting address")
+	}
+	report("198.51.100.2", 51.5, -0.1, 20)
+	report("198.51.100.3", 51.5, -0.1, 20)
+	before, ok := usable()
+	if !ok {
+		t.Fatal("estimate not usable after three reporting addresses")
+	}
+
+	// An outlier only moves the estimate as far as the cap allows
+	report("198.51.100.4", 51.5, -0.1, 60000)
+	after, _ := usable()
+	if limit := before + rttAlpha*(before*rttOutlierFactor-before); after > limit+1e-9 {
+		t.Errorf("outlier moved the estimate from %.2f to %.2f, want at most %.2f", before, after, limit)
+	}
+
+	// The address limit stops a flood, while other addresses keep reporting
+	rttReportLimits = &rateWindow{}
+	for i := 0; i < rttReportsPerIP; i++ {
+		if code := report("203.0.113.9", 51.5, -0.1, 20); code != http.StatusOK {
+			t.Fatalf("report %d answered %d, want 200", i+1, code)
+		}
+	}
+	if code := report("203.0.113.9", 51.5, -0.1, 20); code != http.StatusTooManyRequests {
+		t.Errorf("report past the address limit answered %d, want 429", code)
+	}
+	if code := report("203.0.113.10", 51.5, -0.1, 20); code != http.StatusOK {
+		t.Errorf("report from another address answered %d, want 200", code)
+	}
+}
+
+func TestRTTOverheadKeepsScalesComparable(t *testing.T) {
+	// Two nodes at the same distance from the client, one measured with 15 ms of handshakes and queueing on top
+	near := Node{ID: "measured", Latitude: 10, Longitude: 10.9, Status: "active"}
+	other := Node{ID: "unmeasured", Latitude: 10, Longitude: 9.1, Status: "active"}
+	request := routingRequest{Lat: 10, Lon: 10, Model: "haversine", Fleet: fleetView{Nodes: map[string]Node{near.ID: near, other.ID: other}}}
+	distance := request.distance(near)
+	measured := map[string]float64{near.ID: distance/rttKmPerMillisecond + 15}
+
+	overhead := rttOverheadKm(request, measured)
+	if math.Abs(overhead-15*rttKmPerMillisecond) > 1e-6 {
+		t.Fatalf("overhead %.3f km, want %.3f", overhead, 15*rttKmPerMillisecond)
+	}
+	if got := rttOverheadKm(request, nil); got != 0 {
+		t.Errorf("overhead without measurements %.3f, want 0", got)
+	}
+	if measuredKm, unmeasuredKm := measured[near.ID]*rttKmPerMillisecond, request.distance(other)+overhead; math.Abs(measuredKm-unmeasuredKm) > 1 {
+		t.Errorf("equally distant nodes score %.1f km measured and %.1f km unmeasured", measuredKm, unmeasuredKm)
+	}
+}
+
+// DNS query for a name, with an OPT record carrying the given EDNS options when options is not nil
+func dnsTestQuery(id uint16, name string, queryType uint16, options []byte) []byte {
+	packet := binary.BigEndian.AppendUint16(nil, id)
+	additional := uint16(0)
+	if options != nil {
+		additional = 1
+	}
+	for _, value := range []uint16{0x0100, 1, 0, 0, additional} { // RD set, one question
+		packet = binary.BigEndian.AppendUint16(packet, value)
+	}
+	packet = append(packet, encodeDNSName(name)...)
+	packet = binary.BigEndian.AppendUint16(packet, queryType)
+	packet = binary.BigEndian.AppendUint16(packet, dnsClassIN)
+	if options != nil {
+		packet = append(packet, 0)
+		packet = binary.BigEndian.AppendUint16(packet, dnsTypeOPT)
+		packet = binary.BigEndian.AppendUint16(packet, 4096)
+		packet = binary.BigEndian.AppendUint32(packet, 0)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(len(options)))
+		packet = append(packet, options...)
+	}
+	return packet
+}
+
+// EDNS Client Subnet option for an address and source prefix
+func dnsTestSubnet(family uint16, prefix uint8, address []byte) []byte {
+	option := binary.BigEndian.AppendUint16(nil, ednsClientSubnet)
+	option = binary.BigEndian.AppendUint16(option, uint16(4+len(address)))
+	option = binary.BigEndian.AppendUint16(option, family)
+	option = append(option, prefix, 0)
+	return append(option, address...)
+}
+
+func TestReadDNSName(t *testing.T) {
+	header := func(rest ...byte) []byte { return append(make([]byte, 12), rest...) }
+	tests := []struct {
+		name    string
+		packet  []byte
+		offset  int
+		want    string
+		end     int
+		wantErr bool
+	}{
+		{"plain name", header(encodeDNSName("a.example")...), 12, "a.example", 23, false},
+		{"root", header(0), 12, "", 13, false},
+		{"compression pointer", append(header(encodeDNSName("example")...), 1, 'a', 0xC0, 12), 21, "a.example", 25, false},
+		{"pointer loop", header(0xC0, 12), 12, "", 0, true},
+		{"truncated label", header(5, 'a', 'b'), 12, "", 0, true},
+		{"truncated pointer", header(0xC0), 12, "", 0, true},
+		{"no terminator", header(1, 'a'), 12, "", 0, true},
+		{"extended label type", header(0x40, 0), 12, "", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, end, err := readDNSName(test.packet, test.offset)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && (name != test.want || end != test.end) {
+				t.Fatalf("got %q ending at %d, want %q ending at %d", name, end, test.want, test.end)
+			}
+		})
+	}
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	twoQuestions := dnsTestQuery(1, "nodes.example", dnsTypeA, nil)
+	binary.BigEndian.PutUint16(twoQuestions[4:], 2)
+	response := dnsTestQuery(1, "nodes.example", dnsTypeA, nil)
+	response[2] |= 0x80
+
+	tests := []struct {
+		name       string
+		packet     []byte
+		wantQuery  bool
+		wantErr    bool
+		wantName   string
+		wantType   uint16
+		wantEDNS   bool
+		wantSubnet string
+	}{
+		{"short packet", []byte{1, 2, 3}, false, true, "", 0, false, ""},
+		{"response", response, false, true, "", 0, false, ""},
+		{"two questions", twoQuestions, true, true, "", 0, false, ""},
+		{"truncated question", dnsTestQuery(1, "nodes.example", dnsTypeA, nil)[:20], true, true, "", 0, false, ""},
+		{"plain query", dnsTestQuery(7, "Nodes.Example", dnsTypeAAAA, nil), true, false, "nodes.example", dnsTypeAAAA, false, ""},
+		{"edns without subnet", dnsTestQuery(7, "nodes.example", dnsTypeA, []byte{}), true, false, "nodes.example", dnsTypeA, true, ""},
+		{"edns with subnet", dnsTestQuery(7, "nodes.example", dnsTypeA, dnsTestSubnet(1, 24, []byte{198, 51, 100})), true, false, "nodes.example", dnsTypeA, true, "198.51.100.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := parseDNSQuery(test.packet)
+			if (query != nil) != test.wantQuery || (err != nil) != test.wantErr {
+				t.Fatalf("got query %v and error %v, want query %v and error %v", query, err, test.wantQuery, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if query.Name != test.wantName || query.Type != test.wantType || query.EDNS != test.wantEDNS {
+				t.Fatalf("got %q type %d edns %v, want %q type %d edns %v", query.Name, query.Type, query.EDNS, test.wantName, test.wantType, test.wantEDNS)
+			}
+			subnet := ""
+			if query.Subnet != nil {
+				subnet = query.Subnet.Address.String()
+			}
+			if subnet != test.wantSubnet {
+				t.Fatalf("subnet = %q, want %q", subnet, test.wantSubnet)
+			}
+		})
+	}
+}
+
+func TestParseClientSubnet(t *testing.T) {
+	cookie := []byte{0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8} // Another option before the subnet
+	tests := []struct {
+		name    string
+		options []byte
+		want    string
+		prefix  uint8
+	}{
+		{"ipv4", dnsTestSubnet(1, 24, []byte{203, 0, 113}), "203.0.113.0", 24},
+		{"ipv6", dnsTestSubnet(2, 48, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 1}), "2001:db8:1::", 48},
+		{"after another option", append(cookie, dnsTestSubnet(1, 16, []byte{10, 1})...), "10.1.0.0", 16},
+		{"unknown family", dnsTestSubnet(3, 8, []byte{1}), "", 0},
+		{"option runs past the end", dnsTestSubnet(1, 24, []byte{203, 0, 113})[:6], "", 0},
+		{"no options", nil, "", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subnet := parseClientSubnet(test.options)
+			if test.want == "" {
+				if subnet != nil {
+					t.Fatalf("got subnet %+v, want none", subnet)
+				}
+				return
+			}
+			if subnet == nil || subnet.Address.String() != test.want || subnet.SourcePrefix != test.prefix {
+				t.Fatalf("got subnet %+v, want %s/%d", subnet, test.want, test.prefix)
+			}
+		})
+	}
+}
+
+func TestAnswerDNS(t *testing.T) {
+	resetRegistry(t,
+		Node{ID: "v4", IPAddress: "192.0.2.10", Port: "8081", Latitude: 10, Longitude: 10, Status: "active", Capabilities: []string{"receive", "upload"}},
+		Node{ID: "tunnel", IPAddress: "https://edge.example.net", Latitude: 60, Longitude: 100, Status: "active", Capabilities: []string{"stream"}},
+	)
+	source := net.ParseIP("127.0.0.1")
+	zone := dnsZone
+
+	tests := []struct {
+		name       string
+		query      []byte
+		rcode      uint16
+		answerType uint16
+		answer     []byte
+		scope      int // ECS scope expected in the response, -1 for no ECS option
+	}{
+		{"outside the zone", dnsTestQuery(1, "example.org", dnsTypeA, nil), dnsRcodeRefused, 0, nil, -1},
+		{"nested name", dnsTestQuery(2, "a.b."+zone, dnsTypeA, nil), dnsRcodeNXDomain, 0, nil, -1},
+		{"malformed", dnsTestQuery(3, zone, dnsTypeA, nil)[:20], dnsRcodeFormErr, 0, nil, -1},
+		{"apex A", dnsTestQuery(4, zone, dnsTypeA, nil), 0, dnsTypeA, []byte{192, 0, 2, 10}, -1},
+		{"hostname node as CNAME", dnsTestQuery(5, "stream."+zone, dnsTypeA, nil), 0, dnsTypeCNAME, encodeDNSName("edge.example.net"), -1},
+		{"no AAAA for an IPv4 node", dnsTestQuery(6, "upload."+zone, dnsTypeAAAA, nil), 0, 0, nil, -1},
+		{"subnet echoed with scope", dnsTestQuery(7, zone, dnsTypeA, dnsTestSubnet(1, 24, []byte{203, 0, 113})), 0, dnsTypeA, []byte{192, 0, 2, 10}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := answerDNS(test.query, source)
+			if packet == nil {
+				t.Fatalf("no response")
+			}
+			if id := binary.BigEndian.Uint16(packet); id != binary.BigEndian.Uint16(test.query) {
+				t.Fatalf("response ID %d does not match the query", id)
+			}
+			flags := binary.BigEndian.Uint16(packet[2:])
+			if flags&0x8000 == 0 || flags&0x0100 == 0 {
+				t.Fatalf("flags %#04x lack QR or the echoed RD bit", flags)
+			}
+			if rcode := flags & 0xF; rcode != test.rcode {
+				t.Fatalf("rcode = %d, want %d", rcode, test.rcode)
+			}
+			answers := binary.BigEndian.Uint16(packet[6:])
+			if test.answerType == 0 {
+				if answers != 0 {
+					t.Fatalf("got %d answers, want none", answers)
+				}
+				return
+			}
+
+			query, err := parseDNSQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The answer follows the header and question: pointer, type, class, TTL, length, data
+			offset := 12 + len(query.Question)
+			if answers != 1 || !bytes.Equal(packet[offset:offset+2], []byte{0xC0, 12}) {
+				t.Fatalf("got %d answers starting %v, want one pointing at the question", answers, packet[offset:offset+2])
+			}
+			recordType := binary.BigEndian.Uint16(packet[offset+2:])
+			length := int(binary.BigEndian.Uint16(packet[offset+10:]))
+			data := packet[offset+12 : offset+12+length]
+			if recordType != test.answerType || !bytes.Equal(data, test.answer) {
+				t.Fatalf("answer type %d data %v, want type %d data %v", recordType, data, test.answerType, test.answer)
+			}
+			if test.scope >= 0 {
+				// The OPT record closes the packet, its ECS option last: family, source prefix, scope, address
+				option := packet[len(packet)-7:]
+				if option[2] != 24 || int(option[3]) != test.scope || !bytes.Equal(option[4:], []byte{203, 0, 113}) {
+					t.Fatalf("client subnet option %v, want prefix 24, scope %d and the address echoed", option, test.scope)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeDNSName(t *testing.T) {
+	tests := []struct {
+		name string
+		want []byte
+	}{
+		{"example.org.", []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0}},
+		{"a..b", []byte{1, 'a', 1, 'b', 0}},
+		{strings.Repeat("x", 64) + ".b", []byte{1, 'b', 0}},
+		{"", []byte{0}},
+	}
+	for _, test := range tests {
+		if got := encodeDNSName(test.name); !bytes.Equal(got, test.want) {
+			t.Errorf("encodeDNSName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// A 10x10 degree square around the origin with a 4x4 hole in the middle
+var testSquareWithHole = `{"type": "Polygon", "coordinates": [
+	[[-5, -5], [5, -5], [5, 5], [-5, 5], [-5, -5]],
+	[[-2, -2], [2, -2], [2, 2], [-2, 2], [-2, -2]]
+]}`
+
+func TestGeoPolygonContains(t *testing.T) {
+	area, err := parseGeoJSON(json.RawMessage(testSquareWithHole))
+	if err != nil {
+		t.Fatal(err)
+	}
+	polygon := area[0]
+	if polygon.MinLat != -5 || polygon.MaxLat != 5 || polygon.MinLon != -5 || polygon.MaxLon != 5 {
+		t.Fatalf("bounding box %+v, want ±5 on both axes", polygon)
+	}
+
+	triangle := newGeoPolygon([][][2]float64{{{-5, -5}, {5, -5}, {5, 5}, {-5, -5}}})
+	tests := []struct {
+		name     string
+		polygon  geoPolygon
+		lat, lon float64
+		want     bool
+	}{
+		{"inside the outline", polygon, 3, 3, true},
+		{"inside near an edge", polygon, -4.99, 0, true},
+		{"in the hole", polygon, 0, 0, false},
+		{"in the hole near its edge", polygon, 1.99, -1.99, false},
+		{"east of the outline", polygon, 0, 6, false},
+		{"north of the outline", polygon, 6, 0, false},
+		{"inside the triangle", triangle, -4, 4, true},
+		{"in the triangle's bounding box only", triangle, 4, -4, false},
+	}
+	for _, test := range tests {
+		if got := test.polygon.contains(test.lat, test.lon); got != test.want {
+			t.Errorf("%s: contains(%v, %v) = %v, want %v", test.name, test.lat, test.lon, got, test.want)
+		}
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	const square = `[[[0, 0], [1, 0], [1, 1], [0, 1], [0, 0]]]`
+	const farSquare = `[[[10, 10], [11, 10], [11, 11], [10, 11], [10, 10]]]`
+	tests := []struct {
+		name     string
+		input    string
+		polygons int
+		inside   [][2]float64 // lat, lon pairs the area must contain
+		fails    bool
+	}{
+		{"empty", ``, 0, nil, false},
+		{"null geometry", `null`, 0, nil, false},
+		{"polygon", `{"type": "Polygon", "coordinates": ` + square + `}`, 1, [][2]float64{{0.5, 0.5}}, false},
+		{"multipolygon", `{"type": "MultiPolygon", "coordinates": [` + square + `, ` + farSquare + `]}`, 2, [][2]float64{{0.5, 0.5}, {10.5, 10.5}}, false},
+		{"feature", `{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": ` + square + `}}`, 1, [][2]float64{{0.5, 0.5}}, false},
+		{"feature without geometry", `{"type": "Feature", "geometry": null}`, 0, nil, false},
+		{"feature collection", `{"type": "FeatureCollection", "features": [
+			{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": ` + square + `}},
+			{"type": "Feature", "geometry": {"type": "MultiPolygon", "coordinates": [` + farSquare + `]}}]}`, 2, [][2]float64{{0.5, 0.5}, {10.5, 10.5}}, false},
+		{"geometry collection", `{"type": "GeometryCollection", "geometries": [{"type": "Polygon", "coordinates": ` + farSquare + `}]}`, 1, [][2]float64{{10.5, 10.5}}, false},
+		{"point", `{"type": "Point", "coordinates": [0, 0]}`, 0, nil, true},
+		{"bad coordinates", `{"type": "Polygon", "coordinates": [[0, 0]]}`, 0, nil, true},
+		{"bad member", `{"type": "FeatureCollection", "features": [{"type": "LineString"}]}`, 0, nil, true},
+		{"not JSON", `{"type": `, 0, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			area, err := parseGeoJSON(json.RawMessage(test.input))
+			if (err != nil) != test.fails {
+				t.Fatalf("error = %v, want failure %v", err, test.fails)
+			}
+			if len(area) != test.polygons {
+				t.Fatalf("got %d polygons, want %d", len(area), test.polygons)
+			}
+			for _, point := range test.inside {
+				if !area.contains(point[0], point[1]) {
+					t.Errorf("area does not contain %v", point)
+				}
+			}
+			if area.contains(5, 5) {
+				t.Errorf("area contains (5, 5), which lies between the squares")
+			}
+		})
+	}
+}
+
+func TestGeofenceRules(t *testing.T) {
+	savedAreas, savedRules := geofenceAreas, geofenceRules
+	t.Cleanup(func() { geofenceAreas, geofenceRules = savedAreas, savedRules })
+
+	box := func(minLat, minLon, maxLat, maxLon float64) geoArea {
+		return geoArea{newGeoPolygon([][][2]float64{{{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}, {minLon, minLat}}})}
+	}
+	geofenceAreas = map[string]geoArea{
+		"europe":  box(35, -10, 70, 40),
+		"germany": box(47, 6, 55, 15),
+		"us":      box(25, -125, 49, -67),
+	}
+	geofenceRules = []geofenceRule{
+		{Name: "eu-residency", Clients: "europe", Nodes: []string{"europe"}},
+		{Name: "acme-germany", Tenant: "acme", Nodes: []string{"germany"}},
+		{Name: "beta-us-or-eu", Tenant: "beta", Clients: "us", Nodes: []string{"us", "europe"}},
+	}
+
+	berlin := Node{ID: "berlin", Latitude: 52.52, Longitude: 13.40}
+	paris := Node{ID: "paris", Latitude: 48.86, Longitude: 2.35}
+	newYork := Node{ID: "new-york", Latitude: 40.71, Longitude: -74.01}
+	tests := []struct {
+		name     string
+		tenant   string
+		lat, lon float64
+		rules    []string
+		allowed  []Node
+		refused  []Node
+	}{
+		{"client outside every area", "", -33.87, 151.21, nil, nil, nil},
+		{"european client", "", 48.14, 11.58, []string{"eu-residency"}, []Node{berlin, paris}, []Node{newYork}},
+		{"tenant rule applies anywhere", "acme", 40.71, -74.01, []string{"acme-germany"}, []Node{berlin}, []Node{paris, newYork}},
+		{"rules combine", "acme", 48.14, 11.58, []string{"eu-residency", "acme-germany"}, []Node{berlin}, []Node{paris, newYork}},
+		{"rule allows any listed area", "beta", 40.71, -74.01, []string{"beta-us-or-eu"}, []Node{berlin, paris, newYork}, nil},
+		{"other tenant's rule skipped", "gamma", 40.71, -74.01, nil, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fence := geofenceFor(test.tenant, test.lat, test.lon)
+			if test.rules == nil {
+				if fence != nil {
+					t.Fatalf("got rules %+v, want none", fence.Rules)
+				}
+				return
+			}
+			if fence == nil {
+				t.Fatalf("got no rules, want %v", test.rules)
+			}
+			var names []string
+			for _, rule := range fence.Rules {
+				names = append(names, rule.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.rules) {
+				t.Fatalf("got rules %v, want %v", names, test.rules)
+			}
+			for _, node := range test.allowed {
+				if !fence.allows(node) {
+					t.Errorf("%s refused, want allowed", node.ID)
+				}
+			}
+			for _, node := range test.refused {
+				if fence.allows(node) {
+					t.Errorf("%s allowed, want refused", node.ID)
+				}
+			}
+		})
+	}
+}
@@ -1,7 +1,8 @@
+//go:build node && !windows
+
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,42 +11,15 @@ import (
 	"net"
 	"net/http"
 	"os"
-
-	"os/signal"
 	"path/filepath"
-	"syscall"
 	"time"
 
-	"github.com/google/uuid"
-	"github.com/rs/cors"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/host"
 	"github.com/shirou/gopsutil/load"
 	"github.com/shirou/gopsutil/mem"
 )
 
-// Node structure for server node details
-type Node struct {
-	ID        string  `json:"id"`
-	IPAddress string  `json:"ip_address"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
-	Port      string  `json:"port"`
-	Status    string  `json:"status"`
-}
-
-var serverNode Node
-
-const logFolder = "serverNodeData"
-
-// Ensure log folder exists
-func ensureLogFolder() error {
-	if _, err := os.Stat(logFolder); os.IsNotExist(err) {
-		return os.Mkdir(logFolder, 0755)
-	}
-	return nil
-}
-
 // Function to get the public IP address of the machine
 func getPublicIP() string {
 	// Channel to receive the IP address
@@ -74,68 +48,6 @@ func getPublicIP() string {
 	return <-ipChannel
 }
 
-func getNgrokPublicURL() (string, error) {
-	// Create a channel to receive the result from the goroutine
-	resultChan := make(chan string)
-	errorChan := make(chan error)
-
-	go func() {
-		var ngrokURL string
-		// Start Ngrok
-		// Fetch the public URL from Ngrok API
-		urlResp, err := http.Get("http://localhost:4040/api/tunnels")
-		if err != nil {
-			log.Printf("Error fetching Ngrok public URL: %v\n", err)
-			errorChan <- err
-			return
-		}
-		defer urlResp.Body.Close()
-
-		// Read the response body
-		body, err := ioutil.ReadAll(urlResp.Body)
-		if err != nil {
-			log.Printf("Error reading Ngrok API response: %v\n", err)
-			errorChan <- err
-			return
-		}
-
-		// Parse the response body to extract the public URL (assumes Ngrok is running on localhost:4040)
-		var ngrokAPIResponse struct {
-			Tunnels []struct {
-				PublicURL string `json:"public_url"`
-			} `json:"tunnels"`
-		}
-
-		err = json.Unmarshal(body, &ngrokAPIResponse)
-		if err != nil {
-			log.Printf("Error parsing Ngrok API response: %v\n", err)
-			errorChan <- err
-			return
-		}
-
-		if len(ngrokAPIResponse.Tunnels) == 0 {
-			log.Printf("No tunnels found in Ngrok response\n")
-			errorChan <- fmt.Errorf("no tunnels found")
-			return
-		}
-
-		// Set the Ngrok public URL
-		ngrokURL = ngrokAPIResponse.Tunnels[0].PublicURL
-		log.Printf("Ngrok public URL: %s\n", ngrokURL)
-
-		// Send the result back to the channel
-		resultChan <- ngrokURL
-	}()
-
-	// Wait for the result from the goroutine
-	select {
-	case ngrokURL := <-resultChan:
-		return ngrokURL, nil
-	case err := <-errorChan:
-		return "", err
-	}
-}
-
 // Function to get geolocation using an external API
 func getGeoLocation(ip string) (float64, float64, error) {
 	// Create channels for receiving the result and error
@@ -466,16 +378,12 @@ func savePassiveLog(activity string, systemUsage map[string]interface{}) {
 	}
 }
 
-// Ensure the uploads folder exists
-func ensureUploadsFolder() error {
-	if _, err := os.Stat(logFolder); os.IsNotExist(err) {
-		return os.Mkdir(logFolder, 0755)
-	}
-	return nil
-}
-
 // Handler for file/image upload
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !admitClient(w, r) {
+		return
+	}
+
 	// Limit the size of incoming requests to 10MB
 	r.Body = http.MaxBytesReader(w, r.Body, 10<<20) // Limit to 10MB
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
@@ -527,47 +435,11 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Function to self-register the server node with the main server
-func selfRegister(mainServerURL string, node Node) {
-	data, err := json.Marshal(node)
-	if err != nil {
-		log.Println("Error marshalling node data:", err)
-		return
-	}
-
-	log.Println("Attempting to register with the main server...")
-	resp, err := http.Post(mainServerURL+"/register-node", "application/json", bytes.NewBuffer(data))
-	if err != nil {
-		log.Println("Error registering node with the main server:", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Println("Error reading response body:", err)
-		return
-	}
-
-	log.Printf("Main server response: %s\n", string(responseBody))
-	if resp.StatusCode == http.StatusOK {
-		log.Println("Node successfully registered with the main server.")
-		savePassiveLog("Node registered with main server", nil)
-	} else {
-		log.Printf("Failed to register node. Status code: %d\n", resp.StatusCode)
-		savePassiveLog("Node registration failed", nil)
-	}
-}
-
-// Handler for health check endpoint
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	savePassiveLog("Health check received", nil)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"active"}`))
-}
-
 // Handler for incoming requests (e.g., for receiving data/files)
 func handleRequest(w http.ResponseWriter, r *http.Request) {
+	if !admitClient(w, r) {
+		return
+	}
 	clientIP := r.RemoteAddr
 	requestBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -743,56 +615,31 @@ func main() {
 	ngrokPublicURL = <-ngrokURLChan
 	log.Println("Ngrok Public URL:", ngrokPublicURL)
 
-	// Generate unique node ID
-	nodeID := uuid.New().String()
+	// Reuse the node ID from earlier runs so the main server sees the same node
+	nodeID, err := loadOrCreateNodeID()
+	if err != nil {
+		log.Fatalf("Error loading node ID: %v", err)
+	}
+	log.Println("Node ID:", nodeID)
 
 	// Node information
 	port := "8081"
-	serverNode := Node{
+	serverNode = Node{
 		ID:        nodeID,
 		IPAddress: ngrokPublicURL,
 		Latitude:  latitude,
 		Longitude: longitude,
 		Port:      port,
 		Status:    "active",
-	}
 
-	// Main server URL
-	mainServerURL := "https://nodepulse-5jb7.onrender.com" // Replace with actual main server URL
-
-	// Self-register with the main server
-	selfRegister(mainServerURL, serverNode)
-
-	// Set up HTTP server
-	http.HandleFunc("/receive", handleRequest)
-	http.HandleFunc("/health", healthCheckHandler)
-	http.HandleFunc("/upload", uploadHandler)
-
-	// Enable CORS for all domains
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST"},
-		AllowedHeaders: []string{"Content-Type"},
-	})
-
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: c.Handler(http.DefaultServeMux),
+		// Metadata the main server uses to match clients with nodes
+		Region:       os.Getenv("NODE_REGION"),
+		Zone:         os.Getenv("NODE_ZONE"),
+		Tags:         envList("NODE_TAGS", nil),
+		Capabilities: envList("NODE_CAPABILITIES", []string{"receive", "upload"}),
+		Capacity:     clientCapacity,
+		Version:      nodeVersion,
 	}
 
-	// Graceful shutdown
-	go func() {
-		log.Printf("Server listening on port %s...\n", port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Error starting server: %v", err)
-		}
-	}()
-
-	// Wait for interrupt signal to shut down gracefully
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	<-stop
-
-	log.Println("Shutting down server...")
-	server.Close()
+	runNode(port)
 }
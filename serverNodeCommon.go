@@ -0,0 +1,1361 @@
+//go:build node
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/cors"
+)
+
+// Node structure for server node details
+type Node struct {
+	ID        string  `json:"id"`
+	IPAddress string  `json:"ip_address"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Port      string  `json:"port"`
+	Status    string  `json:"status"`
+
+	Region       string   `json:"region,omitempty"`
+	Zone         string   `json:"zone,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Capacity     int      `json:"capacity,omitempty"`
+	Version      string   `json:"version,omitempty"`
+}
+
+// Version of the server node software, reported at registration
+const nodeVersion = "1.1.0"
+
+var serverNode Node
+
+const logFolder = "serverNodeData"
+
+// Read a comma-separated list from the environment, falling back to a default
+func envList(name string, fallback []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Read a non-negative integer from the environment, falling back to a default
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		log.Printf("Invalid %s value %q, using %d\n", name, value, fallback)
+		return fallback
+	}
+	return number
+}
+
+// Read a duration from the environment, falling back to a default
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Invalid %s value %q, using %s\n", name, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// Ensure log folder exists
+func ensureLogFolder() error {
+	if _, err := os.Stat(logFolder); os.IsNotExist(err) {
+		return os.Mkdir(logFolder, 0755)
+	}
+	return nil
+}
+
+func getNgrokPublicURL() (string, error) {
+	// Create a channel to receive the result from the goroutine
+	resultChan := make(chan string)
+	errorChan := make(chan error)
+
+	go func() {
+		var ngrokURL string
+		// Start Ngrok
+		// Fetch the public URL from Ngrok API
+		urlResp, err := http.Get("http://localhost:4040/api/tunnels")
+		if err != nil {
+			log.Printf("Error fetching Ngrok public URL: %v\n", err)
+			errorChan <- err
+			return
+		}
+		defer urlResp.Body.Close()
+
+		// Read the response body
+		body, err := ioutil.ReadAll(urlResp.Body)
+		if err != nil {
+			log.Printf("Error reading Ngrok API response: %v\n", err)
+			errorChan <- err
+			return
+		}
+
+		// Parse the response body to extract the public URL (assumes Ngrok is running on localhost:4040)
+		var ngrokAPIResponse struct {
+			Tunnels []struct {
+				PublicURL string `json:"public_url"`
+			} `json:"tunnels"`
+		}
+
+		err = json.Unmarshal(body, &ngrokAPIResponse)
+		if err != nil {
+			log.Printf("Error parsing Ngrok API response: %v\n", err)
+			errorChan <- err
+			return
+		}
+
+		if len(ngrokAPIResponse.Tunnels) == 0 {
+			log.Printf("No tunnels found in Ngrok response\n")
+			errorChan <- fmt.Errorf("no tunnels found")
+			return
+		}
+
+		// Set the Ngrok public URL
+		ngrokURL = ngrokAPIResponse.Tunnels[0].PublicURL
+		log.Printf("Ngrok public URL: %s\n", ngrokURL)
+
+		// Send the result back to the channel
+		resultChan <- ngrokURL
+	}()
+
+	// Wait for the result from the goroutine
+	select {
+	case ngrokURL := <-resultChan:
+		return ngrokURL, nil
+	case err := <-errorChan:
+		return "", err
+	}
+}
+
+// Ensure the uploads folder exists
+func ensureUploadsFolder() error {
+	if _, err := os.Stat(logFolder); os.IsNotExist(err) {
+		return os.Mkdir(logFolder, 0755)
+	}
+	return nil
+}
+
+// Pre-shared key used to sign control calls to the main server
+var (
+	nodeKeyID  = os.Getenv("NODE_KEY_ID")
+	nodeSecret = os.Getenv("NODE_KEY")
+)
+
+// Function to POST a signed JSON body to the main server
+func postToMainServer(mainServerURL string, path string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, mainServerURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signRequest(req, data)
+	return mainServerClient.Do(req)
+}
+
+// Sign a request with the node's pre-shared key: hex HMAC-SHA256 of "METHOD\nREQUEST-URI\nTIMESTAMP\n" + body
+func signRequest(req *http.Request, body []byte) {
+	if nodeKeyID == "" || nodeSecret == "" {
+		return // Only accepted by main servers running with ALLOW_UNAUTHENTICATED_NODES=true
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Node-Key-Id", nodeKeyID)
+	req.Header.Set("X-Node-Timestamp", timestamp)
+	req.Header.Set("X-Node-Signature", hex.EncodeToString(requestMAC([]byte(nodeSecret), req.Method, req.URL.RequestURI(), timestamp, body)))
+}
+
+// HMAC-SHA256 of "METHOD\nREQUEST-URI\nTIMESTAMP\n" + body
+func requestMAC(secret []byte, method, requestURI, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, requestURI, timestamp)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// mTLS settings for control calls to the main server
+var (
+	mainServerMTLSURL = os.Getenv("MAIN_SERVER_MTLS_URL")              // mTLS listener of the main server, e.g. https://localhost:8443; empty keeps plain HTTP
+	controlTimeout    = envDuration("CONTROL_TIMEOUT", 10*time.Second) // Time allowed for a single control call
+	mainServerClient  = &http.Client{Timeout: controlTimeout}          // Client for control calls, replaced by an mTLS client after enrollment
+	nodeCertificate   tls.Certificate                                  // Certificate presented to the main server, checked for renewal with every heartbeat
+)
+
+// Function to load the node certificate, enrolling with the main server when it is missing or about to expire
+func setupMTLS(mainServerURL string) error {
+	keyPath := filepath.Join(logFolder, "node-key.pem")
+	certPath := filepath.Join(logFolder, "node-cert.pem")
+	caPath := filepath.Join(logFolder, "main-ca.pem")
+
+	certificate, certErr := tls.LoadX509KeyPair(certPath, keyPath)
+	caPEM, caErr := ioutil.ReadFile(caPath)
+	if certErr != nil || caErr != nil || certificateExpiresSoon(certificate) {
+		log.Println("Enrolling with the main server for a node certificate...")
+		if err := enrollNode(mainServerURL, keyPath, certPath, caPath); err != nil {
+			return err
+		}
+		var err error
+		if certificate, err = tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+			return err
+		}
+		if caPEM, err = ioutil.ReadFile(caPath); err != nil {
+			return err
+		}
+	}
+
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("invalid CA certificate in %s", caPath)
+	}
+	nodeCertificate = certificate
+	mainServerClient = &http.Client{
+		Timeout: controlTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{certificate},
+				RootCAs:      rootCAs,
+				MinVersion:   tls.VersionTLS12,
+			},
+		},
+	}
+	return nil
+}
+
+// Check whether a certificate is missing or within a week (or a third of its lifetime, if shorter) of expiry
+func certificateExpiresSoon(certificate tls.Certificate) bool {
+	if len(certificate.Certificate) == 0 {
+		return true
+	}
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return true
+	}
+	window := 7 * 24 * time.Hour
+	if lifetime := parsed.NotAfter.Sub(parsed.NotBefore); lifetime/3 < window {
+		window = lifetime / 3
+	}
+	return time.Until(parsed.NotAfter) < window
+}
+
+// Enroll again when the node certificate is about to expire, so long-running nodes keep their access
+func renewCertificateIfDue(enrollURL string) {
+	if mainServerMTLSURL == "" || !certificateExpiresSoon(nodeCertificate) {
+		return
+	}
+	if err := setupMTLS(enrollURL); err != nil {
+		log.Printf("Error renewing node certificate: %v\n", err)
+		return
+	}
+	log.Println("Node certificate renewed")
+}
+
+// Function to get a certificate for this node from the main server's CA
+func enrollNode(mainServerURL string, keyPath, certPath, caPath string) error {
+	if err := ensureLogFolder(); err != nil {
+		return err
+	}
+	if nodeKeyID == "" || nodeSecret == "" {
+		return fmt.Errorf("enrollment needs NODE_KEY_ID and NODE_KEY")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: serverNode.ID},
+	}, key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]string{
+		"id":  serverNode.ID,
+		"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, mainServerURL+"/enroll-node", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signRequest(req, data)
+	resp, err := (&http.Client{Timeout: controlTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("enrollment rejected (status %d): %s", resp.StatusCode, responseBody)
+	}
+
+	// Only trust the CA certificate if the response is signed with our key
+	mac := hmac.New(sha256.New, []byte(nodeSecret))
+	fmt.Fprintf(mac, "%s\n", req.Header.Get("X-Node-Signature"))
+	mac.Write(responseBody)
+	signature, err := hex.DecodeString(resp.Header.Get("X-Enrollment-Signature"))
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("enrollment response is not signed with this node's key")
+	}
+
+	var enrollment struct {
+		Certificate   string `json:"certificate"`
+		CACertificate string `json:"ca_certificate"`
+	}
+	if err := json.Unmarshal(responseBody, &enrollment); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certPath, []byte(enrollment.Certificate), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(caPath, []byte(enrollment.CACertificate), 0644); err != nil {
+		return err
+	}
+	savePassiveLog("Node certificate issued by main server", nil)
+	return nil
+}
+
+// How long in-flight requests get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// Function to tell the main server about a lifecycle change of this node (drain, deregister)
+func notifyMainServer(mainServerURL string, path string) {
+	data, err := json.Marshal(map[string]string{"id": serverNode.ID})
+	if err != nil {
+		log.Println("Error marshalling node ID:", err)
+		return
+	}
+
+	resp, err := postToMainServer(mainServerURL, path, data)
+	if err != nil {
+		log.Printf("Error calling %s on the main server: %v\n", path, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Main server rejected %s. Status code: %d\n", path, resp.StatusCode)
+		return
+	}
+	log.Printf("Main server accepted %s\n", path)
+	savePassiveLog("Main server accepted "+path, nil)
+}
+
+// Load the persisted node ID, generating and saving a new one on first start
+func loadOrCreateNodeID() (string, error) {
+	if err := ensureLogFolder(); err != nil {
+		return "", err
+	}
+
+	idFile := filepath.Join(logFolder, "node_id")
+	data, err := ioutil.ReadFile(idFile)
+	if err == nil {
+		if nodeID := strings.TrimSpace(string(data)); nodeID != "" {
+			return nodeID, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	nodeID := uuid.New().String()
+	if err := ioutil.WriteFile(idFile, []byte(nodeID+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return nodeID, nil
+}
+
+// Function to self-register the server node with the main server
+func selfRegister(mainServerURL string, node Node) {
+	data, err := json.Marshal(node)
+	if err != nil {
+		log.Println("Error marshalling node data:", err)
+		return
+	}
+
+	log.Println("Attempting to register with the main server...")
+	resp, err := postToMainServer(mainServerURL, "/register-node", data)
+	if err != nil {
+		log.Println("Error registering node with the main server:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading response body:", err)
+		return
+	}
+
+	log.Printf("Main server response: %s\n", string(responseBody))
+	if resp.StatusCode == http.StatusOK {
+		log.Println("Node successfully registered with the main server.")
+		savePassiveLog("Node registered with main server", nil)
+		adoptHeartbeatInterval(responseBody)
+		seedMembers(responseBody)
+	} else {
+		log.Printf("Failed to register node. Status code: %d\n", resp.StatusCode)
+		savePassiveLog("Node registration failed", nil)
+	}
+}
+
+// Interval between heartbeats, updated from the main server's responses
+var heartbeatInterval = 10 * time.Second
+
+// Use the heartbeat interval announced by the main server, if any
+func adoptHeartbeatInterval(responseBody []byte) {
+	var response struct {
+		HeartbeatInterval string `json:"heartbeat_interval"`
+	}
+	if err := json.Unmarshal(responseBody, &response); err != nil || response.HeartbeatInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(response.HeartbeatInterval)
+	if err != nil || interval <= 0 {
+		log.Printf("Ignoring invalid heartbeat interval from main server: %q\n", response.HeartbeatInterval)
+		return
+	}
+	heartbeatInterval = interval
+}
+
+// How long a client counts as active after its last request
+const activeClientWindow = 30 * time.Second
+
+var (
+	clientCapacity = envInt("NODE_CAPACITY", 0) // Most clients served at once (0 = unlimited), also declared to the main server
+	clientLastSeen = make(map[string]time.Time) // Last request time by client address, guarded by clientsMutex
+	clientsMutex   = &sync.Mutex{}
+)
+
+// Proxies whose X-Forwarded-For entries are believed (TRUSTED_PROXIES, IPs or CIDRs, loopback by default)
+var trustedProxies = parseTrustedProxies(envList("TRUSTED_PROXIES", []string{"127.0.0.1", "::1"}))
+
+// Parse a list of IPs and CIDR ranges, skipping invalid entries
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q\n", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Check whether an address belongs to a trusted proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address of the client behind an HTTP request. X-Forwarded-For is only followed through trusted
+// proxies: walking it from the right, the first address that is not a trusted proxy is the client.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Admit a client's request and remember it, or reject it with 503 and a nearby peer when the node is full
+func admitClient(w http.ResponseWriter, r *http.Request) bool {
+	client := r.RemoteAddr
+	if ip := clientIP(r); ip != nil {
+		client = ip.String()
+	}
+
+	clientsMutex.Lock()
+	seen, known := clientLastSeen[client]
+	known = known && time.Since(seen) <= activeClientWindow
+	if !known && clientCapacity > 0 && countActiveClients() >= clientCapacity {
+		clientsMutex.Unlock()
+		rejectAtCapacity(w, client)
+		return false
+	}
+	clientLastSeen[client] = time.Now()
+	clientsMutex.Unlock()
+	return true
+}
+
+// Tell a client the node is full, pointing it at the nearest live peer
+func rejectAtCapacity(w http.ResponseWriter, client string) {
+	response := map[string]interface{}{"error": "Node is at capacity", "capacity": clientCapacity}
+	if peer, ok := nearestPeer(); ok {
+		url := memberURL(peer)
+		w.Header().Set("X-Alternative-Node", url)
+		response["alternative_node"] = map[string]interface{}{
+			"id":        peer.ID,
+			"url":       url,
+			"latitude":  peer.Latitude,
+			"longitude": peer.Longitude,
+		}
+	}
+	savePassiveLog("Client rejected at capacity", map[string]interface{}{"client": client})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(activeClientWindow.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Nearest peer the gossip layer believes alive. Only peers the main server handed out qualify,
+// at the address it gave, so gossip alone cannot steer rejected clients elsewhere.
+func nearestPeer() (Node, bool) {
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+
+	var nearest Node
+	best := math.Inf(1)
+	for id, peer := range members {
+		vouched, ok := vouchedPeers[id]
+		if peer.State != "alive" || !ok || memberURL(vouched) != memberURL(peer.Node) {
+			continue
+		}
+		if distance := distanceKm(serverNode.Latitude, serverNode.Longitude, vouched.Latitude, vouched.Longitude); distance < best {
+			nearest, best = vouched, distance
+		}
+	}
+	return nearest, !math.IsInf(best, 1)
+}
+
+// Number of clients seen within the window, forgetting older ones (caller holds clientsMutex)
+func countActiveClients() int {
+	for client, seen := range clientLastSeen {
+		if time.Since(seen) > activeClientWindow {
+			delete(clientLastSeen, client)
+		}
+	}
+	return len(clientLastSeen)
+}
+
+// Number of clients seen within the window
+func activeClients() int {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	return countActiveClients()
+}
+
+// Heartbeat payload: the node ID plus its current utilization, when it can be measured
+func buildHeartbeat() map[string]interface{} {
+	heartbeat := map[string]interface{}{"id": serverNode.ID}
+
+	usageData, err := captureSystemUsage()
+	if err != nil {
+		log.Printf("Error capturing system usage for heartbeat: %v\n", err)
+		heartbeat["load"] = map[string]interface{}{"active_clients": activeClients()}
+		return heartbeat
+	}
+	heartbeat["load"] = map[string]interface{}{
+		"cpu_percent":    usageData["CPU Usage %"],
+		"memory_percent": usageData["Memory Used %"],
+		"load_average":   usageData["Load Average (1m)"],
+		"active_clients": activeClients(),
+	}
+	return heartbeat
+}
+
+// Function to keep the node's lease alive on the main server until ctx is cancelled,
+// renewing the mTLS certificate through enrollURL when it nears expiry
+func sendHeartbeats(ctx context.Context, mainServerURL string, enrollURL string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(heartbeatInterval):
+		}
+		renewCertificateIfDue(enrollURL)
+
+		data, err := json.Marshal(buildHeartbeat())
+		if err != nil {
+			log.Println("Error marshalling heartbeat:", err)
+			continue
+		}
+
+		resp, err := postToMainServer(mainServerURL, "/heartbeat", data)
+		if err != nil {
+			log.Println("Error sending heartbeat to the main server:", err)
+			continue
+		}
+		responseBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Println("Error reading heartbeat response:", err)
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			adoptHeartbeatInterval(responseBody)
+		case http.StatusNotFound:
+			// The main server restarted or evicted us, so register again, unless we are shutting down
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("Main server does not know this node, registering again...")
+			selfRegister(mainServerURL, serverNode)
+		default:
+			log.Printf("Heartbeat rejected. Status code: %d\n", resp.StatusCode)
+		}
+	}
+}
+
+// Gossip settings for the membership layer between server nodes
+var (
+	gossipInterval       = envDuration("GOSSIP_INTERVAL", 2*time.Second)         // Protocol period: one member is checked per period
+	gossipPingTimeout    = envDuration("GOSSIP_PING_TIMEOUT", time.Second)       // How long to wait for an ack
+	gossipSuspectTimeout = envDuration("GOSSIP_SUSPECT_TIMEOUT", 10*time.Second) // How long a suspect member has to refute before it is declared dead
+	gossipIndirectChecks = envInt("GOSSIP_INDIRECT_CHECKS", 3)                   // Members asked to ping a target that missed a direct ping
+)
+
+// Gossip authentication: every message between nodes is signed with a key shared by the fleet
+var (
+	gossipSecret               = []byte(os.Getenv("GOSSIP_KEY"))                     // Shared by all nodes; never the node's own NODE_KEY
+	allowUnauthenticatedGossip = os.Getenv("ALLOW_UNAUTHENTICATED_GOSSIP") == "true" // Local development only
+	gossipMaxSkew              = envDuration("GOSSIP_MAX_SKEW", 5*time.Minute)       // Oldest/newest accepted message timestamp
+	seenGossipNonces           = make(map[string]time.Time)                          // Nonces of accepted messages until they leave the window, guarded by gossipNoncesMutex
+	gossipNoncesMutex          = &sync.Mutex{}
+)
+
+const (
+	gossipMaxUpdates    = 8               // Membership updates piggybacked on each message
+	gossipDeadRetention = 5 * time.Minute // How long dead members are remembered so stale updates cannot revive them
+	gossipMaxBody       = 1 << 20         // Largest gossip message accepted
+)
+
+// Membership state of one node as carried in gossip messages
+type memberUpdate struct {
+	Node        Node   `json:"node"`
+	State       string `json:"state"` // "alive", "suspect" or "dead"
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// This node's view of a peer
+type member struct {
+	memberUpdate
+	Changed time.Time // When State last changed
+}
+
+// Body of /gossip/ping and /gossip/ping-req requests and their replies
+type gossipMessage struct {
+	From    memberUpdate   `json:"from"`
+	Target  string         `json:"target,omitempty"` // ping-req: the member to check
+	Ack     bool           `json:"ack,omitempty"`    // ping-req reply: whether the target answered
+	Updates []memberUpdate `json:"updates,omitempty"`
+}
+
+// Membership update still being spread to other members
+type gossipBroadcast struct {
+	update    memberUpdate
+	transmits int
+}
+
+var (
+	members         = make(map[string]*member)  // Peers by node ID, guarded by membersMutex
+	broadcasts      []*gossipBroadcast          // Guarded by membersMutex
+	pingOrder       []string                    // Members left to ping this round, guarded by membersMutex
+	vouchedPeers    = make(map[string]Node)     // Peers as the main server handed them out, guarded by membersMutex
+	selfIncarnation = uint64(time.Now().Unix()) // Starts from the clock so a restarted node outranks its old "dead" entry
+	membersMutex    = &sync.Mutex{}
+	gossipClient    = &http.Client{}
+)
+
+// Base URL of a node, as the main server builds it
+func memberURL(node Node) string {
+	if strings.Contains(node.IPAddress, "://") {
+		return strings.TrimRight(node.IPAddress, "/")
+	}
+	return "http://" + net.JoinHostPort(node.IPAddress, node.Port)
+}
+
+// Great-circle distance between two points in kilometres
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Order of membership states: at equal incarnation the later one wins
+func stateRank(state string) int {
+	switch state {
+	case "suspect":
+		return 1
+	case "dead":
+		return 2
+	}
+	return 0
+}
+
+// Add the peers handed out by the main server at registration
+func seedMembers(responseBody []byte) {
+	var response struct {
+		Peers []Node `json:"peers"`
+	}
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return
+	}
+
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+	vouchedPeers = make(map[string]Node, len(response.Peers))
+	for _, peer := range response.Peers {
+		if peer.ID == serverNode.ID || peer.ID == "" {
+			continue
+		}
+		vouchedPeers[peer.ID] = peer
+		if _, known := members[peer.ID]; known {
+			continue
+		}
+		// Incarnation 0 lets the peer's own announcement replace this entry
+		members[peer.ID] = &member{memberUpdate: memberUpdate{Node: peer, State: "alive"}, Changed: time.Now()}
+		log.Printf("Gossip: seeded peer %s\n", peer.ID)
+	}
+	queueBroadcast(selfUpdate())
+}
+
+// This node's own membership entry (caller holds membersMutex)
+func selfUpdate() memberUpdate {
+	return memberUpdate{Node: serverNode, State: "alive", Incarnation: selfIncarnation}
+}
+
+// Start spreading an update, replacing any older update about the same node (caller holds membersMutex)
+func queueBroadcast(update memberUpdate) {
+	for i, queued := range broadcasts {
+		if queued.update.Node.ID == update.Node.ID {
+			broadcasts = append(broadcasts[:i], broadcasts[i+1:]...)
+			break
+		}
+	}
+	broadcasts = append(broadcasts, &gossipBroadcast{update: update})
+}
+
+// Pick the least-sent updates for the next message (caller holds membersMutex)
+func takeBroadcasts() []memberUpdate {
+	// Each update is sent about 3*log2(n) times, enough to reach every member with high probability
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(members)+2))))
+
+	sort.SliceStable(broadcasts, func(i, j int) bool { return broadcasts[i].transmits < broadcasts[j].transmits })
+	var updates []memberUpdate
+	for _, queued := range broadcasts {
+		if len(updates) == gossipMaxUpdates {
+			break
+		}
+		updates = append(updates, queued.update)
+		queued.transmits++
+	}
+
+	kept := broadcasts[:0]
+	for _, queued := range broadcasts {
+		if queued.transmits < limit {
+			kept = append(kept, queued)
+		}
+	}
+	broadcasts = kept
+	return updates
+}
+
+// Merge a membership update into the local view (caller holds membersMutex)
+func applyUpdate(update memberUpdate) {
+	if update.Node.ID == "" || update.Incarnation == math.MaxUint64 {
+		return // An incarnation that cannot be refuted with a higher one is never legitimate
+	}
+	if update.Node.ID == serverNode.ID {
+		// Someone suspects us: refute with a higher incarnation
+		if update.State != "alive" && update.Incarnation >= selfIncarnation {
+			selfIncarnation = update.Incarnation + 1
+			queueBroadcast(selfUpdate())
+		}
+		return
+	}
+
+	existing, known := members[update.Node.ID]
+	if !known {
+		if update.State == "dead" {
+			return
+		}
+		members[update.Node.ID] = &member{memberUpdate: update, Changed: time.Now()}
+		queueBroadcast(update)
+		log.Printf("Gossip: peer %s joined (%s)\n", update.Node.ID, update.State)
+		savePassiveLog("Gossip peer joined: "+update.Node.ID, nil)
+		return
+	}
+
+	if update.Incarnation < existing.Incarnation ||
+		(update.Incarnation == existing.Incarnation && stateRank(update.State) <= stateRank(existing.State)) {
+		return // Stale or already known
+	}
+	if update.State != existing.State {
+		existing.Changed = time.Now()
+		log.Printf("Gossip: peer %s is %s\n", update.Node.ID, update.State)
+		savePassiveLog("Gossip peer "+update.State+": "+update.Node.ID, nil)
+	}
+	existing.memberUpdate = update
+	queueBroadcast(update)
+}
+
+// Merge everything a gossip message carries
+func applyMessage(message gossipMessage) {
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+	applyUpdate(message.From)
+	for _, update := range message.Updates {
+		applyUpdate(update)
+	}
+}
+
+// Sign a gossip request the way control calls are signed, plus a random nonce so every message is unique:
+// X-Gossip-Signature is the hex HMAC-SHA256 of "METHOD\nREQUEST-URI\nTIMESTAMP\n" + nonce + "\n" + body
+func signGossip(req *http.Request, body []byte) {
+	if len(gossipSecret) == 0 {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	signed := append([]byte(hex.EncodeToString(nonce)+"\n"), body...)
+	req.Header.Set("X-Gossip-Timestamp", timestamp)
+	req.Header.Set("X-Gossip-Nonce", hex.EncodeToString(nonce))
+	req.Header.Set("X-Gossip-Signature", hex.EncodeToString(requestMAC(gossipSecret, req.Method, req.URL.RequestURI(), timestamp, signed)))
+}
+
+// Read and check a signed gossip request, accepting each nonce once within the window
+func verifyGossip(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, gossipMaxBody))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %v", err)
+	}
+	if allowUnauthenticatedGossip {
+		return body, nil
+	}
+	if len(gossipSecret) == 0 {
+		return nil, fmt.Errorf("gossip is disabled on this node")
+	}
+
+	timestamp := r.Header.Get("X-Gossip-Timestamp")
+	nonce := r.Header.Get("X-Gossip-Nonce")
+	signature := r.Header.Get("X-Gossip-Signature")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || signature == "" {
+		return nil, fmt.Errorf("missing gossip signature")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > gossipMaxSkew || skew < -gossipMaxSkew {
+		return nil, fmt.Errorf("timestamp outside the accepted window")
+	}
+	provided, err := hex.DecodeString(signature)
+	signed := append([]byte(nonce+"\n"), body...)
+	if err != nil || !hmac.Equal(provided, requestMAC(gossipSecret, r.Method, r.URL.RequestURI(), timestamp, signed)) {
+		return nil, fmt.Errorf("bad gossip signature")
+	}
+
+	gossipNoncesMutex.Lock()
+	defer gossipNoncesMutex.Unlock()
+	now := time.Now()
+	for seen, expires := range seenGossipNonces {
+		if now.After(expires) {
+			delete(seenGossipNonces, seen)
+		}
+	}
+	if _, replayed := seenGossipNonces[nonce]; replayed {
+		return nil, fmt.Errorf("replayed gossip message")
+	}
+	seenGossipNonces[nonce] = signedAt.Add(gossipMaxSkew)
+	return body, nil
+}
+
+// Signature binding a gossip reply to the request it answers
+func gossipReplyMAC(requestSignature string, body []byte) []byte {
+	mac := hmac.New(sha256.New, gossipSecret)
+	fmt.Fprintf(mac, "%s\n", requestSignature)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Send a signed reply to a gossip request
+func writeGossipReply(w http.ResponseWriter, r *http.Request, reply gossipMessage) {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		http.Error(w, "Error encoding reply", http.StatusInternalServerError)
+		return
+	}
+	if len(gossipSecret) > 0 {
+		w.Header().Set("X-Gossip-Signature", hex.EncodeToString(gossipReplyMAC(r.Header.Get("X-Gossip-Signature"), data)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Send a gossip message to a member and merge its reply
+func sendGossip(node Node, path string, message gossipMessage, timeout time.Duration) (gossipMessage, error) {
+	var reply gossipMessage
+	data, err := json.Marshal(message)
+	if err != nil {
+		return reply, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, memberURL(node)+path, bytes.NewReader(data))
+	if err != nil {
+		return reply, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signGossip(req, data)
+
+	resp, err := gossipClient.Do(req)
+	if err != nil {
+		return reply, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reply, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	replyBody, err := io.ReadAll(io.LimitReader(resp.Body, gossipMaxBody))
+	if err != nil {
+		return reply, err
+	}
+	if !allowUnauthenticatedGossip {
+		signature, err := hex.DecodeString(resp.Header.Get("X-Gossip-Signature"))
+		if err != nil || !hmac.Equal(signature, gossipReplyMAC(req.Header.Get("X-Gossip-Signature"), replyBody)) {
+			return reply, fmt.Errorf("reply is not signed with the gossip key")
+		}
+	}
+	if err := json.Unmarshal(replyBody, &reply); err != nil {
+		return reply, err
+	}
+	applyMessage(reply)
+	return reply, nil
+}
+
+// A fresh outgoing message with this node's entry and pending updates
+func newGossipMessage() gossipMessage {
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+	return gossipMessage{From: selfUpdate(), Updates: takeBroadcasts()}
+}
+
+// Next member to ping: every live member once per round, in random order
+func nextPingTarget() (member, bool) {
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(pingOrder) > 0 {
+			id := pingOrder[0]
+			pingOrder = pingOrder[1:]
+			if target, ok := members[id]; ok && target.State != "dead" {
+				return *target, true
+			}
+		}
+		for id := range members {
+			pingOrder = append(pingOrder, id)
+		}
+		mathrand.Shuffle(len(pingOrder), func(i, j int) { pingOrder[i], pingOrder[j] = pingOrder[j], pingOrder[i] })
+	}
+	return member{}, false
+}
+
+// Ask a few other members to ping the target for us
+func indirectPing(target member) bool {
+	membersMutex.Lock()
+	var helpers []Node
+	for id, candidate := range members {
+		if id != target.Node.ID && candidate.State == "alive" {
+			helpers = append(helpers, candidate.Node)
+		}
+	}
+	membersMutex.Unlock()
+	mathrand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > gossipIndirectChecks {
+		helpers = helpers[:gossipIndirectChecks]
+	}
+
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper Node) {
+			message := newGossipMessage()
+			message.Target = target.Node.ID
+			reply, err := sendGossip(helper, "/gossip/ping-req", message, 2*gossipPingTimeout)
+			acks <- err == nil && reply.Ack
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
+}
+
+// Check one member per protocol period and age out suspects and dead members
+func runGossip() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expireMembers(time.Now())
+
+		target, ok := nextPingTarget()
+		if !ok {
+			continue
+		}
+		if _, err := sendGossip(target.Node, "/gossip/ping", newGossipMessage(), gossipPingTimeout); err == nil {
+			continue
+		}
+		if indirectPing(target) {
+			continue
+		}
+
+		membersMutex.Lock()
+		if current, ok := members[target.Node.ID]; ok && current.State == "alive" && current.Incarnation == target.Incarnation {
+			applyUpdate(memberUpdate{Node: current.Node, State: "suspect", Incarnation: current.Incarnation})
+		}
+		membersMutex.Unlock()
+	}
+}
+
+// Declare suspects dead after the timeout and forget long-dead members
+func expireMembers(now time.Time) {
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+
+	for id, peer := range members {
+		switch {
+		case peer.State == "suspect" && now.Sub(peer.Changed) >= gossipSuspectTimeout:
+			applyUpdate(memberUpdate{Node: peer.Node, State: "dead", Incarnation: peer.Incarnation})
+		case peer.State == "dead" && now.Sub(peer.Changed) >= gossipDeadRetention:
+			delete(members, id)
+		}
+	}
+}
+
+// Tell a few members that this node is leaving, so they do not wait for the suspect timeout
+func leaveGossip() {
+	membersMutex.Lock()
+	leave := memberUpdate{Node: serverNode, State: "dead", Incarnation: selfIncarnation}
+	var peers []Node
+	for _, peer := range members {
+		if peer.State == "alive" {
+			peers = append(peers, peer.Node)
+		}
+	}
+	membersMutex.Unlock()
+
+	if len(peers) > gossipIndirectChecks {
+		peers = peers[:gossipIndirectChecks]
+	}
+	for _, peer := range peers {
+		if _, err := sendGossip(peer, "/gossip/ping", gossipMessage{From: leave, Updates: []memberUpdate{leave}}, gossipPingTimeout); err != nil {
+			log.Printf("Error announcing leave to %s: %v\n", peer.ID, err)
+		}
+	}
+}
+
+// Read a signed gossip message from a request, answering 401 or 400 when it is not acceptable
+func readGossipMessage(w http.ResponseWriter, r *http.Request) (gossipMessage, bool) {
+	var message gossipMessage
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return message, false
+	}
+	body, err := verifyGossip(r)
+	if err != nil {
+		savePassiveLog("Rejected gossip message", map[string]interface{}{"remote": r.RemoteAddr, "reason": err.Error()})
+		http.Error(w, "Gossip message rejected: "+err.Error(), http.StatusUnauthorized)
+		return message, false
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return message, false
+	}
+	return message, true
+}
+
+// Handler for direct gossip pings
+func gossipPingHandler(w http.ResponseWriter, r *http.Request) {
+	message, ok := readGossipMessage(w, r)
+	if !ok {
+		return
+	}
+	applyMessage(message)
+
+	reply := newGossipMessage()
+	reply.Ack = true
+	writeGossipReply(w, r, reply)
+}
+
+// Handler for indirect pings: check the target on behalf of the sender
+func gossipPingReqHandler(w http.ResponseWriter, r *http.Request) {
+	message, ok := readGossipMessage(w, r)
+	if !ok {
+		return
+	}
+
+	// Only relay to a member this node already knew, never to an address the message itself introduces
+	membersMutex.Lock()
+	target, known := members[message.Target]
+	var targetNode Node
+	if known {
+		known = target.State != "dead"
+		targetNode = target.Node
+	}
+	membersMutex.Unlock()
+	applyMessage(message)
+
+	reply := newGossipMessage()
+	if known {
+		_, err := sendGossip(targetNode, "/gossip/ping", newGossipMessage(), gossipPingTimeout)
+		reply.Ack = err == nil
+	}
+	writeGossipReply(w, r, reply)
+}
+
+// Handler for the local membership view, nearest peers first (?near=N limits the count, ?radius_km= the distance)
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit, radius := 0, 0.0
+	if value := query.Get("near"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid near", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if value := query.Get("radius_km"); value != "" {
+		km, err := strconv.ParseFloat(value, 64)
+		if err != nil || km < 0 {
+			http.Error(w, "Invalid radius_km", http.StatusBadRequest)
+			return
+		}
+		radius = km
+	}
+	includeAll := query.Get("all") == "true" // Include suspect and dead members too
+
+	type peerView struct {
+		memberUpdate
+		DistanceKm float64 `json:"distance_km"`
+	}
+	membersMutex.Lock()
+	self := selfUpdate()
+	var view []peerView
+	for _, peer := range members {
+		if peer.State != "alive" && !includeAll {
+			continue
+		}
+		distance := distanceKm(serverNode.Latitude, serverNode.Longitude, peer.Node.Latitude, peer.Node.Longitude)
+		if radius > 0 && distance > radius {
+			continue
+		}
+		view = append(view, peerView{memberUpdate: peer.memberUpdate, DistanceKm: distance})
+	}
+	membersMutex.Unlock()
+
+	sort.Slice(view, func(i, j int) bool { return view[i].DistanceKm < view[j].DistanceKm })
+	if limit > 0 && len(view) > limit {
+		view = view[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"self": self, "peers": view})
+}
+
+// Handler for health check endpoint
+func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	savePassiveLog("Health check received", nil)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"active"}`))
+}
+
+// Register with the main server, keep the lease and the gossip membership up, and serve until
+// interrupted; then drain and leave the registry
+func runNode(port string) {
+	// Main server URL
+	mainServerURL := "https://nodepulse-5jb7.onrender.com" // Replace with actual main server URL
+
+	if nodeKeyID == "" || nodeSecret == "" {
+		log.Println("NODE_KEY_ID/NODE_KEY not set, requests to the main server will be unsigned")
+	}
+
+	// Send control calls over mutual TLS when the main server offers it
+	enrollURL := mainServerURL
+	if mainServerMTLSURL != "" {
+		if err := setupMTLS(mainServerURL); err != nil {
+			log.Fatalf("Error setting up mTLS with the main server: %v", err)
+		}
+		mainServerURL = mainServerMTLSURL
+		log.Println("Using mTLS for main server calls:", mainServerURL)
+	}
+
+	// Self-register with the main server
+	selfRegister(mainServerURL, serverNode)
+
+	// Keep the registration alive with periodic heartbeats
+	heartbeatCtx, stopHeartbeats := context.WithCancel(context.Background())
+	heartbeatsDone := make(chan struct{})
+	go func() {
+		sendHeartbeats(heartbeatCtx, mainServerURL, enrollURL)
+		close(heartbeatsDone)
+	}()
+
+	// Track the other nodes directly, so the peer list survives main server outages. The gossip
+	// key is shared by the fleet, so it must not be a key the main server accepts from this node
+	if len(gossipSecret) > 0 && string(gossipSecret) == nodeSecret {
+		log.Println("GOSSIP_KEY must differ from NODE_KEY, gossip with other nodes is disabled")
+		gossipSecret = nil
+	}
+	if len(gossipSecret) > 0 || allowUnauthenticatedGossip {
+		go runGossip()
+	} else {
+		log.Println("GOSSIP_KEY not set, gossip with other nodes is disabled")
+	}
+
+	// Set up HTTP server
+	http.HandleFunc("/receive", handleRequest)
+	http.HandleFunc("/health", healthCheckHandler)
+	http.HandleFunc("/upload", uploadHandler)
+	http.HandleFunc("/gossip/ping", gossipPingHandler)
+	http.HandleFunc("/gossip/ping-req", gossipPingReqHandler)
+	http.HandleFunc("/peers", peersHandler)
+
+	// Enable CORS for all domains
+	c := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Content-Type", "X-Gossip-Timestamp", "X-Gossip-Nonce", "X-Gossip-Signature"},
+	})
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: c.Handler(http.DefaultServeMux),
+	}
+
+	// Graceful shutdown
+	go func() {
+		log.Printf("Server listening on port %s...\n", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Wait for interrupt signal to shut down gracefully
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down server...")
+
+	// Stop the lease first so a heartbeat cannot register the node again after it leaves
+	stopHeartbeats()
+	<-heartbeatsDone
+
+	// Stop receiving new clients, let in-flight requests finish, then leave the registry
+	notifyMainServer(mainServerURL, "/drain-node")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error draining in-flight requests: %v\n", err)
+		server.Close()
+	}
+
+	notifyMainServer(mainServerURL, "/deregister-node")
+	leaveGossip()
+	log.Println("Server stopped.")
+}
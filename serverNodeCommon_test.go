@@ -0,0 +1,120 @@
+//go:build node
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "servernode-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// A gossip ping from the given member, signed with the given key, nonce and timestamp
+func signedGossipPing(t *testing.T, secret []byte, from string, nonce string, signedAt time.Time) (*http.Request, []byte) {
+	t.Helper()
+	body, err := json.Marshal(gossipMessage{From: memberUpdate{Node: Node{ID: from, IPAddress: "10.0.0.1", Port: "9000"}, State: "alive", Incarnation: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	r := httptest.NewRequest(http.MethodPost, "/gossip/ping", bytes.NewReader(body))
+	r.Header.Set("X-Gossip-Timestamp", timestamp)
+	r.Header.Set("X-Gossip-Nonce", nonce)
+	signed := append([]byte(nonce+"\n"), body...)
+	r.Header.Set("X-Gossip-Signature", hex.EncodeToString(requestMAC(secret, r.Method, r.URL.RequestURI(), timestamp, signed)))
+	return r, body
+}
+
+func TestGossipAuthentication(t *testing.T) {
+	savedSecret, savedAllow := gossipSecret, allowUnauthenticatedGossip
+	gossipSecret, allowUnauthenticatedGossip = []byte("fleet gossip key"), false
+	t.Cleanup(func() { gossipSecret, allowUnauthenticatedGossip = savedSecret, savedAllow })
+
+	sentAt := time.Now()
+	nonce := func(i int) string { return hex.EncodeToString([]byte("nonce-" + strconv.Itoa(i) + "-padding")) }
+	tests := []struct {
+		name    string
+		request func(from string) *http.Request // Sent after an accepted ping from "earlier" with nonce 0
+		want    int
+	}{
+		{"signed", func(from string) *http.Request {
+			r, _ := signedGossipPing(t, gossipSecret, from, nonce(1), time.Now())
+			return r
+		}, http.StatusOK},
+		{"unsigned", func(from string) *http.Request {
+			r, _ := signedGossipPing(t, gossipSecret, from, nonce(2), time.Now())
+			r.Header.Del("X-Gossip-Signature")
+			return r
+		}, http.StatusUnauthorized},
+		{"wrong key", func(from string) *http.Request {
+			r, _ := signedGossipPing(t, []byte("node key"), from, nonce(3), time.Now())
+			return r
+		}, http.StatusUnauthorized},
+		{"tampered body", func(from string) *http.Request {
+			r, _ := signedGossipPing(t, gossipSecret, "honest", nonce(4), time.Now())
+			_, forged := signedGossipPing(t, gossipSecret, from, nonce(4), time.Now())
+			r.Body = io.NopCloser(bytes.NewReader(forged))
+			return r
+		}, http.StatusUnauthorized},
+		{"stale", func(from string) *http.Request {
+			r, _ := signedGossipPing(t, gossipSecret, from, nonce(5), time.Now().Add(-2*gossipMaxSkew))
+			return r
+		}, http.StatusUnauthorized},
+		{"replayed", func(from string) *http.Request {
+			r, _ := signedGossipPing(t, gossipSecret, "earlier", nonce(0), sentAt)
+			return r
+		}, http.StatusUnauthorized},
+		{"reused nonce", func(from string) *http.Request {
+			r, _ := signedGossipPing(t, gossipSecret, from, nonce(0), time.Now())
+			return r
+		}, http.StatusUnauthorized},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			membersMutex.Lock()
+			members = make(map[string]*member)
+			membersMutex.Unlock()
+			gossipNoncesMutex.Lock()
+			seenGossipNonces = make(map[string]time.Time)
+			gossipNoncesMutex.Unlock()
+
+			earlier, _ := signedGossipPing(t, gossipSecret, "earlier", nonce(0), sentAt)
+			accepted := httptest.NewRecorder()
+			if gossipPingHandler(accepted, earlier); accepted.Code != http.StatusOK {
+				t.Fatalf("signed ping rejected with status %d", accepted.Code)
+			}
+
+			from := "peer-" + strconv.Itoa(i)
+			w := httptest.NewRecorder()
+			gossipPingHandler(w, test.request(from))
+			if w.Code != test.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+			membersMutex.Lock()
+			_, joined := members[from]
+			membersMutex.Unlock()
+			if joined != (test.want == http.StatusOK) {
+				t.Fatalf("sender joined = %v after status %d", joined, w.Code)
+			}
+		})
+	}
+}